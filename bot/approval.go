@@ -0,0 +1,404 @@
+package bot
+
+/* approval.go - two-person approval for commands listed in a plugin's
+   ApprovalCommands. Requests are posted to the approvals channel and kept
+   in the brain until another member of the plugin's ApprovalGroup (one of
+   the Groups) approves or denies them, or they expire. */
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long to wait for an approval, in seconds, by default
+const defaultApprovalTimeout = 900
+
+// brain key for pending approval requests
+const approvalDatum = "builtInapproval:requests"
+
+// approvalRequest is a command waiting on approval
+type approvalRequest struct {
+	ID          int
+	User        string            // the user that issued the command
+	Identity    string            // the canonical identity of User
+	Channel     string            // where the command was issued
+	Plugin      string            // name of the plugin
+	Command     string            // the plugin command
+	Args        []string          // the command arguments
+	NamedArgs   map[string]string // named arguments, from Robot.Args()
+	Annotations map[string]string // annotations from middleware
+	Group       string            // the ApprovalGroup for the plugin, from Groups
+	Expires     time.Time
+}
+
+// approvalStore is what's stored in the brain
+type approvalStore struct {
+	NextID   int
+	Requests map[string]*approvalRequest
+}
+
+// serializes changes to the datum, so request IDs are never reused
+var approvals = struct {
+	sync.Mutex
+}{
+	sync.Mutex{},
+}
+
+// approvalSettings returns the configured approvals channel, groups and
+// timeout
+func approvalSettings() (channel string, groups map[string][]string, timeout time.Duration) {
+	robot.RLock()
+	channel, groups = robot.approvalChannel, robot.approvalGroups
+	seconds := robot.approvalTimeout
+	robot.RUnlock()
+	if seconds == 0 {
+		seconds = defaultApprovalTimeout
+	}
+	return channel, groups, time.Duration(seconds) * time.Second
+}
+
+// identity is the canonical identity of the requester; requests saved
+// before identities were recorded fall back to the handle.
+func (req *approvalRequest) identity() string {
+	if req.Identity != "" {
+		return req.Identity
+	}
+	return req.User
+}
+
+// describe gives a one-line description of the request for messages
+func (req *approvalRequest) describe() string {
+	where := "a direct message"
+	if req.Channel != "" {
+		where = "channel " + req.Channel
+	}
+	args := "(none)"
+	if len(req.Args) > 0 {
+		quoted := make([]string, 0, len(req.Args))
+		for _, arg := range req.Args {
+			if arg != "" {
+				quoted = append(quoted, fmt.Sprintf("\"%s\"", arg))
+			}
+		}
+		if len(quoted) > 0 {
+			args = strings.Join(quoted, ", ")
+		}
+	}
+	return fmt.Sprintf("#%d: %s wants to run \"%s\" (plugin %s) in %s, arguments: %s", req.ID, req.User, req.Command, req.Plugin, where, args)
+}
+
+// requestor gives a Robot for messaging the user that made the request
+func (req *approvalRequest) requestor() *Robot {
+	return &Robot{
+		User:        req.User,
+		Channel:     req.Channel,
+		Format:      Variable,
+		annotations: req.Annotations,
+	}
+}
+
+// updateApprovals checks out the approvals datum, calls update, and saves
+// the result if update returns true.
+func updateApprovals(update func(store *approvalStore) bool) RetVal {
+	approvals.Lock()
+	defer approvals.Unlock()
+	var store approvalStore
+	locktoken, _, ret := checkoutDatum(approvalDatum, &store, true)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error checking out approval requests from the brain: %s", ret))
+		return ret
+	}
+	if store.Requests == nil {
+		store.Requests = make(map[string]*approvalRequest)
+	}
+	if !update(&store) {
+		checkinDatum(approvalDatum, locktoken)
+		return Ok
+	}
+	if ret := updateDatum(approvalDatum, locktoken, store); ret != Ok {
+		Log(Error, fmt.Sprintf("Error saving approval requests to the brain: %s", ret))
+		return ret
+	}
+	return Ok
+}
+
+// needsApproval checks whether a command is listed in the plugin's
+// ApprovalCommands
+func needsApproval(plugin *Plugin, command string) bool {
+	for _, c := range plugin.ApprovalCommands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// requestApproval records and posts a request for approval when the command
+// is listed in the plugin's ApprovalCommands. It returns true if the command
+// was held for approval (or couldn't be), and shouldn't be run now.
+func requestApproval(bot *Robot, plugin *Plugin, command string, cmdArgs []string) bool {
+	if !needsApproval(plugin, command) {
+		return false
+	}
+	channel, _, timeout := approvalSettings()
+	members := approvers(plugin.ApprovalGroup)
+	if len(members) == 0 {
+		Log(Error, fmt.Sprintf("Approval group \"%s\" for plugin \"%s\" has no members, can't approve command \"%s\"", plugin.ApprovalGroup, plugin.name, command))
+		bot.Reply(fmt.Sprintf("Sorry, \"%s\" needs approval, but nobody is able to approve it", command))
+		return true
+	}
+	req := &approvalRequest{
+		User:        bot.User,
+		Identity:    bot.CanonicalUser(),
+		Channel:     bot.Channel,
+		Plugin:      plugin.name,
+		Command:     command,
+		Args:        cmdArgs,
+		NamedArgs:   bot.args,
+		Annotations: bot.annotations,
+		Group:       plugin.ApprovalGroup,
+		Expires:     time.Now().Add(timeout),
+	}
+	ret := updateApprovals(func(store *approvalStore) bool {
+		store.NextID++
+		req.ID = store.NextID
+		store.Requests[strconv.Itoa(req.ID)] = req
+		return true
+	})
+	if ret != Ok {
+		bot.Reply(fmt.Sprintf("Sorry, \"%s\" needs approval, but I wasn't able to record the request", command))
+		return true
+	}
+	Log(Audit, fmt.Sprintf("Approval requested %s; approval group \"%s\", expires %s", req.describe(), req.Group, req.Expires.Format(time.RFC3339)))
+	notice := fmt.Sprintf("Approval request %s. Approvers (%s): reply \"approve %d\" or \"deny %d\" within %s", req.describe(), strings.Join(members, ", "), req.ID, req.ID, timeout)
+	if channel != "" {
+		bot.SendChannelMessage(channel, notice)
+		bot.Reply(fmt.Sprintf("The \"%s\" command needs approval; I've posted request #%d in %s", command, req.ID, channel))
+	} else {
+		bot.Say(notice)
+	}
+	time.AfterFunc(timeout, func() { expireApproval(req.ID) })
+	return true
+}
+
+// expireApproval removes a request that hasn't been approved or denied in
+// time.
+func expireApproval(id int) {
+	var req *approvalRequest
+	updateApprovals(func(store *approvalStore) bool {
+		var ok bool
+		key := strconv.Itoa(id)
+		if req, ok = store.Requests[key]; !ok {
+			return false
+		}
+		delete(store.Requests, key)
+		return true
+	})
+	if req == nil {
+		return
+	}
+	req.expired()
+}
+
+// expired logs the expiration of a request and lets the requester know
+func (req *approvalRequest) expired() {
+	Log(Audit, fmt.Sprintf("Approval request %s expired without approval", req.describe()))
+	req.requestor().Reply(fmt.Sprintf("Request #%d to run \"%s\" expired without being approved", req.ID, req.Command))
+}
+
+// restoreApprovals is called when the robot starts; the expiration timers
+// for pending requests were lost when it stopped, so requests that expired
+// in the meantime are expired now, and timers are started for the rest.
+func restoreApprovals() {
+	var expired []*approvalRequest
+	pending := make(map[int]time.Time)
+	now := time.Now()
+	updateApprovals(func(store *approvalStore) bool {
+		for key, req := range store.Requests {
+			if now.After(req.Expires) {
+				expired = append(expired, req)
+				delete(store.Requests, key)
+				continue
+			}
+			pending[req.ID] = req.Expires
+		}
+		return len(expired) > 0
+	})
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	for _, req := range expired {
+		req.expired()
+	}
+	for id, expires := range pending {
+		id := id
+		time.AfterFunc(expires.Sub(now), func() { expireApproval(id) })
+	}
+	if len(pending) > 0 {
+		Log(Info, fmt.Sprintf("Restored expiration timers for %d pending approval requests", len(pending)))
+	}
+}
+
+// approvers returns the members of an approval group, for telling users
+// who can approve a request. A plugin's ApprovalGroup is a group from
+// Groups; the flat ApprovalGroups are only a deprecated fallback.
+func approvers(group string) []string {
+	groups := configuredGroups()
+	if _, ok := groups[group]; ok {
+		changes, ret := loadGroupChanges()
+		if ret != Ok {
+			return groups[group]
+		}
+		return groupMembers(groups, changes, group)
+	}
+	_, approvalGroups, _ := approvalSettings()
+	return approvalGroups[group]
+}
+
+// isApprover checks whether the user is a member of the approval group,
+// including through nested groups
+func isApprover(user, group string) bool {
+	groups := configuredGroups()
+	if _, ok := groups[group]; ok {
+		changes, ret := loadGroupChanges()
+		if ret != Ok {
+			return false
+		}
+		return inGroup(groups, changes, user, group, make(map[string]bool))
+	}
+	_, approvalGroups, _ := approvalSettings()
+	return contains(approvalGroups[group], user)
+}
+
+// decideApproval handles the approve and deny commands
+func decideApproval(bot *Robot, approve bool, id int, reason string) {
+	var req *approvalRequest
+	var expired bool
+	decision := "denied"
+	if approve {
+		decision = "approved"
+	}
+	identity := bot.CanonicalUser()
+	ret := updateApprovals(func(store *approvalStore) bool {
+		var ok bool
+		key := strconv.Itoa(id)
+		if req, ok = store.Requests[key]; !ok {
+			return false
+		}
+		if time.Now().After(req.Expires) {
+			expired = true
+			delete(store.Requests, key)
+			return true
+		}
+		if req.identity() == identity || !isApprover(identity, req.Group) {
+			return false
+		}
+		delete(store.Requests, key)
+		return true
+	})
+	if ret != Ok {
+		bot.Reply("Sorry, I wasn't able to check the approval requests")
+		return
+	}
+	switch {
+	case req == nil:
+		bot.Reply(fmt.Sprintf("I don't have a pending approval request #%d", id))
+		return
+	case expired:
+		Log(Audit, fmt.Sprintf("Approval request %s expired before user \"%s\" %s it", req.describe(), bot.User, decision))
+		bot.Reply(fmt.Sprintf("Sorry, request #%d has already expired", id))
+		req.requestor().Reply(fmt.Sprintf("Request #%d to run \"%s\" expired without being approved", req.ID, req.Command))
+		return
+	case req.identity() == identity:
+		Log(Audit, fmt.Sprintf("User \"%s\" tried to decide their own approval request %s", bot.User, req.describe()))
+		bot.Reply("Sorry, a different user has to approve or deny your request")
+		return
+	case !isApprover(identity, req.Group):
+		Log(Audit, fmt.Sprintf("User \"%s\" isn't in approval group \"%s\", not allowed to decide request %s", bot.User, req.Group, req.describe()))
+		bot.Reply(fmt.Sprintf("Sorry, only members of the \"%s\" group can approve or deny request #%d", req.Group, id))
+		return
+	}
+	if reason != "" {
+		Log(Audit, fmt.Sprintf("User \"%s\" %s request %s, reason: %s", bot.User, decision, req.describe(), reason))
+	} else {
+		Log(Audit, fmt.Sprintf("User \"%s\" %s request %s", bot.User, decision, req.describe()))
+	}
+	requestor := req.requestor()
+	if !approve {
+		msg := fmt.Sprintf("Request #%d to run \"%s\" was denied by %s", req.ID, req.Command, bot.User)
+		if reason != "" {
+			msg += ": " + reason
+		}
+		requestor.Reply(msg)
+		bot.Reply(fmt.Sprintf("Ok, request #%d denied", id))
+		return
+	}
+	plugin := currentPlugins.getPluginByName(req.Plugin)
+	if plugin == nil || plugin.Disabled {
+		Log(Audit, fmt.Sprintf("Approved request %s not run, plugin \"%s\" is no longer available", req.describe(), req.Plugin))
+		bot.Reply(fmt.Sprintf("Request #%d was approved, but plugin \"%s\" isn't available any more", id, req.Plugin))
+		return
+	}
+	bot.Reply(fmt.Sprintf("Ok, request #%d approved", id))
+	requestor.Reply(fmt.Sprintf("Request #%d to run \"%s\" was approved by %s, running it now", req.ID, req.Command, bot.User))
+	requestor.args = req.NamedArgs
+	go callPlugin(requestor, plugin, true, true, req.Command, req.Args...)
+}
+
+// listApprovals lists the pending requests, dropping any that have expired
+func listApprovals(bot *Robot) {
+	var pending, expired []*approvalRequest
+	now := time.Now()
+	ret := updateApprovals(func(store *approvalStore) bool {
+		for key, req := range store.Requests {
+			if now.After(req.Expires) {
+				expired = append(expired, req)
+				delete(store.Requests, key)
+				continue
+			}
+			pending = append(pending, req)
+		}
+		return len(expired) > 0
+	})
+	for _, req := range expired {
+		req.expired()
+	}
+	if ret != Ok {
+		bot.Reply("Sorry, I wasn't able to check the approval requests")
+		return
+	}
+	if len(pending) == 0 {
+		bot.Say("There are no pending approval requests")
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	lines := make([]string, 0, len(pending)+1)
+	lines = append(lines, "Pending approval requests:")
+	for _, req := range pending {
+		lines = append(lines, fmt.Sprintf("%s (group %s, expires in %s)", req.describe(), req.Group, req.Expires.Sub(now)/time.Second*time.Second))
+	}
+	bot.Fixed().Say(strings.Join(lines, "\n"))
+}
+
+func approval(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	switch command {
+	case "init":
+		restoreApprovals()
+	case "approvals":
+		listApprovals(bot)
+	case "approve", "deny":
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			bot.Reply(fmt.Sprintf("Invalid request number: %s", args[0]))
+			return
+		}
+		reason := ""
+		if len(args) > 1 {
+			reason = strings.TrimSpace(args[1])
+		}
+		decideApproval(bot, command == "approve", id, reason)
+	}
+	return
+}
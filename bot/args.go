@@ -0,0 +1,164 @@
+package bot
+
+/* args.go - named capture groups and typed arguments for matchers. Arguments
+   are validated before the plugin is called, and passed to Go plugins via
+   Robot.Args() and to external plugins as GOPHER_ARG_<NAME> environment
+   variables. */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgSpec describes a named capture group in a matcher regex
+type ArgSpec struct {
+	Name     string   // Name of the capture group, from (?P<name>...)
+	Type     string   // One of string (the default), int, duration, user, channel or enum
+	Default  string   // Value to use when the group didn't match anything
+	Required bool     // When true, the command isn't run unless a value is given or defaulted
+	Values   []string // The allowed values for an enum
+}
+
+// valid user and channel names, after stripping a leading @ or #
+var argNameRe = regexp.MustCompile(`^[\w.-]+$`)
+
+// characters not allowed in environment variable names
+var envNameRe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// validateArgs checks the Args for a matcher against it's compiled regex
+func (matcher *InputMatcher) validateArgs() error {
+	names := make(map[string]bool)
+	for _, name := range matcher.re.SubexpNames() {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for _, arg := range matcher.Args {
+		if !names[arg.Name] {
+			return fmt.Errorf("Args for command \"%s\" refers to \"%s\", which isn't a named group in the regex", matcher.Command, arg.Name)
+		}
+		switch arg.Type {
+		case "", "string", "int", "duration", "user", "channel":
+		case "enum":
+			if len(arg.Values) == 0 {
+				return fmt.Errorf("enum argument \"%s\" for command \"%s\" has no Values", arg.Name, matcher.Command)
+			}
+		default:
+			return fmt.Errorf("argument \"%s\" for command \"%s\" has unknown Type \"%s\"", arg.Name, matcher.Command, arg.Type)
+		}
+		if arg.Default != "" {
+			if _, err := arg.convert(arg.Default); err != nil {
+				return fmt.Errorf("invalid Default for argument \"%s\" of command \"%s\": %v", arg.Name, matcher.Command, err)
+			}
+		}
+	}
+	return nil
+}
+
+// convert checks a value against the argument Type, and returns it in a
+// normal form: durations are whole seconds, users and channels lose a leading
+// @ or #, and enums use the case given in Values.
+func (arg ArgSpec) convert(value string) (string, error) {
+	switch arg.Type {
+	case "int":
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("\"%s\" isn't a whole number", value)
+		}
+		return strconv.Itoa(i), nil
+	case "duration":
+		// a plain number is taken as seconds
+		if s, err := strconv.Atoi(value); err == nil {
+			return strconv.Itoa(s), nil
+		}
+		d, err := time.ParseDuration(strings.Replace(value, " ", "", -1))
+		if err != nil {
+			return "", fmt.Errorf("\"%s\" isn't a duration like 90s, 5m or 1h30m", value)
+		}
+		return strconv.Itoa(int(d / time.Second)), nil
+	case "user":
+		u := strings.TrimPrefix(value, "@")
+		if !argNameRe.MatchString(u) {
+			return "", fmt.Errorf("\"%s\" doesn't look like a user name", value)
+		}
+		return u, nil
+	case "channel":
+		c := strings.TrimPrefix(value, "#")
+		if !argNameRe.MatchString(c) {
+			return "", fmt.Errorf("\"%s\" doesn't look like a channel name", value)
+		}
+		return c, nil
+	case "enum":
+		for _, v := range arg.Values {
+			if strings.EqualFold(v, value) {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("\"%s\" isn't one of: %s", value, strings.Join(arg.Values, ", "))
+	}
+	return value, nil
+}
+
+// namedArgs applies defaults and types to the named capture groups of a
+// matched command, updating cmdArgs in place so positional arguments match.
+// It returns the named arguments, or an error suitable for the user.
+func namedArgs(matcher InputMatcher, cmdArgs []string) (map[string]string, error) {
+	names := matcher.re.SubexpNames()
+	if len(names) < 2 {
+		return nil, nil
+	}
+	specs := make(map[string]ArgSpec)
+	for _, arg := range matcher.Args {
+		specs[arg.Name] = arg
+	}
+	args := make(map[string]string)
+	for i, name := range names[1:] {
+		if name == "" || i >= len(cmdArgs) {
+			continue
+		}
+		value := cmdArgs[i]
+		spec, ok := specs[name]
+		if ok {
+			if value == "" {
+				value = spec.Default
+			}
+			if value == "" && spec.Required {
+				return nil, fmt.Errorf("the %s is required", name)
+			}
+			if value != "" {
+				var err error
+				if value, err = spec.convert(value); err != nil {
+					return nil, fmt.Errorf("invalid %s: %v", name, err)
+				}
+			}
+		}
+		cmdArgs[i] = value
+		args[name] = value
+	}
+	return args, nil
+}
+
+// argsEnv returns GOPHER_ARG_<NAME>=<value> environment variables for
+// external plugins
+func argsEnv(args map[string]string) []string {
+	env := make([]string, 0, len(args))
+	for name, value := range args {
+		envName := envNameRe.ReplaceAllString(strings.ToUpper(name), "_")
+		env = append(env, fmt.Sprintf("GOPHER_ARG_%s=%s", envName, value))
+	}
+	return env
+}
+
+// Args returns the named arguments for the command, from named capture
+// groups in the matcher regex, e.g. (?P<host>[\w.-]+). Values are validated
+// and converted according to the matcher's Args, with defaults applied.
+func (r *Robot) Args() map[string]string {
+	args := make(map[string]string, len(r.args))
+	for name, value := range r.args {
+		args[name] = value
+	}
+	return args
+}
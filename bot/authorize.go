@@ -7,7 +7,8 @@ const configAuthError = "Sorry, authorization failed due to a configuration erro
 
 // Check for a configured Authorizer and check authorization
 func (bot *Robot) checkAuthorization(plugins []*Plugin, plugin *Plugin, command string, args ...string) (retval PlugRetVal) {
-	if !(plugin.AuthorizeAllCommands || len(plugin.AuthorizedCommands) > 0) {
+	authRequire, commandGroup := plugin.CommandAuthRequire[command]
+	if !(plugin.AuthorizeAllCommands || len(plugin.AuthorizedCommands) > 0 || len(plugin.CommandAuthRequire) > 0) {
 		// This plugin requires no authorization
 		if plugin.Authorizer != "" {
 			Log(Error, fmt.Sprintf("Plugin \"%s\" configured an authorizer, but has no commands requiring authorization", plugin.name))
@@ -15,7 +16,7 @@ func (bot *Robot) checkAuthorization(plugins []*Plugin, plugin *Plugin, command
 			return ConfigurationError
 		}
 		return Success
-	} else if !plugin.AuthorizeAllCommands {
+	} else if !plugin.AuthorizeAllCommands && !commandGroup {
 		authRequired := false
 		for _, i := range plugin.AuthorizedCommands {
 			if command == i {
@@ -27,6 +28,9 @@ func (bot *Robot) checkAuthorization(plugins []*Plugin, plugin *Plugin, command
 			return Success
 		}
 	}
+	if !commandGroup {
+		authRequire = plugin.AuthRequire
+	}
 	robot.RLock()
 	defaultAuthorizer := robot.defaultAuthorizer
 	robot.RUnlock()
@@ -42,36 +46,36 @@ func (bot *Robot) checkAuthorization(plugins []*Plugin, plugin *Plugin, command
 	for _, authPlug := range plugins {
 		if authorizer == authPlug.name {
 			if !pluginAvailable(bot.User, bot.Channel, authPlug) {
-				Log(Error, fmt.Sprintf("Auth plugin \"%s\" not available while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+				Log(Error, fmt.Sprintf("Auth plugin \"%s\" not available while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, authRequire))
 				bot.Say(configAuthError)
 				return ConfigurationError
 			}
-			args = append([]string{plugin.name, plugin.AuthRequire, command}, args...)
+			args = append([]string{plugin.name, authRequire, command}, args...)
 			authRet := callPlugin(bot, authPlug, false, false, "authorize", args...)
 			if authRet == Success {
 				return Success
 			}
 			if authRet == Fail {
-				Log(Warn, fmt.Sprintf("Authorization failed by authorizer \"%s\" for user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+				Log(Warn, fmt.Sprintf("Authorization failed by authorizer \"%s\" for user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, authRequire))
 				bot.Say("Sorry, you're not authorized for that command in this channel")
 				return Fail
 			}
 			if authRet == MechanismFail {
-				Log(Error, fmt.Sprintf("Auth plugin \"%s\" mechanism failure while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+				Log(Error, fmt.Sprintf("Auth plugin \"%s\" mechanism failure while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, authRequire))
 				bot.Say(technicalAuthError)
 				return MechanismFail
 			}
 			if authRet == Normal {
-				Log(Error, fmt.Sprintf("Auth plugin \"%s\" returned 'Normal' (0) instead of 'Success' (1), failing auth in \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+				Log(Error, fmt.Sprintf("Auth plugin \"%s\" returned 'Normal' (0) instead of 'Success' (1), failing auth in \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, bot.User, command, plugin.name, bot.Channel, authRequire))
 				bot.Say(technicalAuthError)
 				return MechanismFail
 			}
-			Log(Error, fmt.Sprintf("Auth plugin \"%s\" exit code %d, failing auth while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, authRet, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+			Log(Error, fmt.Sprintf("Auth plugin \"%s\" exit code %d, failing auth while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", authPlug.name, authRet, bot.User, command, plugin.name, bot.Channel, authRequire))
 			bot.Say(technicalAuthError)
 			return MechanismFail
 		}
 	}
-	Log(Error, fmt.Sprintf("Auth plugin \"%s\" not found while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", plugin.Authorizer, bot.User, command, plugin.name, bot.Channel, plugin.AuthRequire))
+	Log(Error, fmt.Sprintf("Auth plugin \"%s\" not found while authenticating user \"%s\" calling command \"%s\" for plugin \"%s\" in channel \"%s\"; AuthRequire: \"%s\"", plugin.Authorizer, bot.User, command, plugin.name, bot.Channel, authRequire))
 	bot.Say(technicalAuthError)
 	return ConfigurationError
 }
@@ -41,31 +41,46 @@ func RegisterConnector(name string, connstarter func(Handler, *log.Logger) Conne
 // robot holds all the interal data relevant to the Bot. Most of it is populated
 // by loadConfig, other stuff is populated by the connector.
 var robot struct {
-	Connector                           // Connector interface, implemented by each specific protocol
-	localPath          string           // Directory for local files overriding default config
-	installPath        string           // Path to the bot's installation directory
-	adminUsers         []string         // List of users with access to administrative commands
-	alias              rune             // single-char alias for addressing the bot
-	name               string           // e.g. "Gort"
-	fullName           string           // e.g. "Robbie Robot"
-	adminContact       string           // who to contact for problems with the robot.
-	email              string           // the from: when the robot sends email
-	mailConf           botMailer        // configuration to use when sending email
-	ignoreUsers        []string         // list of users to never listen to, like other bots
-	preRegex           *regexp.Regexp   // regex for matching prefixed commands, e.g. "Gort, drop your weapon"
-	postRegex          *regexp.Regexp   // regex for matching, e.g. "open the pod bay doors, hal"
-	joinChannels       []string         // list of channels to join
-	defaultAllowDirect bool             // whether plugins are available in DM by default
-	plugChannels       []string         // list of channels where plugins are active by default
-	sync.RWMutex                        // for safe updating of bot data structures
-	protocol           string           // Name of the protocol, e.g. "slack"
-	brainProvider      string           // Type of Brain provider to use
-	brain              SimpleBrain      // Interface for robot to Store and Retrieve data
-	defaultElevator    string           // Plugin name for performing elevation
-	defaultAuthorizer  string           // Plugin name for performing authorization
-	externalPlugins    []externalPlugin // List of external plugins to load
-	port               string           // Localhost port to listen on
-	logger             *log.Logger      // Where to log to
+	Connector                              // Connector interface, implemented by each specific protocol
+	localPath          string              // Directory for local files overriding default config
+	installPath        string              // Path to the bot's installation directory
+	adminUsers         []string            // List of users with access to administrative commands
+	alias              rune                // single-char alias for addressing the bot
+	name               string              // e.g. "Gort"
+	fullName           string              // e.g. "Robbie Robot"
+	adminContact       string              // who to contact for problems with the robot.
+	email              string              // the from: when the robot sends email
+	mailConf           botMailer           // configuration to use when sending email
+	ignoreUsers        []string            // list of users to never listen to, like other bots
+	preRegex           *regexp.Regexp      // regex for matching prefixed commands, e.g. "Gort, drop your weapon"
+	postRegex          *regexp.Regexp      // regex for matching, e.g. "open the pod bay doors, hal"
+	joinChannels       []string            // list of channels to join
+	defaultAllowDirect bool                // whether plugins are available in DM by default
+	plugChannels       []string            // list of channels where plugins are active by default
+	sync.RWMutex                           // for safe updating of bot data structures
+	protocol           string              // Name of the protocol, e.g. "slack"
+	brainProvider      string              // Type of Brain provider to use
+	brain              SimpleBrain         // Interface for robot to Store and Retrieve data
+	defaultElevator    string              // Plugin name for performing elevation
+	defaultAuthorizer  string              // Plugin name for performing authorization
+	externalPlugins    []externalPlugin    // List of external plugins to load
+	port               string              // Localhost port to listen on
+	maxConcurrent      int                 // Maximum number of plugins running at once, 0 for unlimited
+	queuedReply        string              // Reply when a job has to wait for a free slot
+	rateLimits         []RateLimit         // Robot-wide rate limits for commands
+	rateLimitReply     string              // Reply when a command is rate limited
+	middleware         []string            // Ordered list of middleware to run on incoming messages
+	historySize        int                 // Number of commands to remember per user and channel
+	historyInBrain     bool                // Whether command history is kept in the brain
+	approvalChannel    string              // Channel where approval requests are posted
+	approvalGroups     map[string][]string // Deprecated groups of users who can approve ApprovalCommands, see Groups
+	approvalTimeout    int                 // Seconds to wait for an approval
+	groups             map[string][]string // Groups for the builtin group authorizer
+	roles              map[string]Role     // Roles granting permissions to users and groups
+	userRoster         map[string]UserInfo // User attributes from gopherbot.yaml
+	attrPrecedence     string              // Whether protocol or roster user attributes take precedence
+	userIDs            map[string]string   // Protocol internal IDs -> canonical user names, from the UserRoster
+	logger             *log.Logger         // Where to log to
 }
 
 //var robot *robotcfg
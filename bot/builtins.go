@@ -14,23 +14,32 @@ import (
 // if help is more than tooLong lines long, send a private message
 const tooLong = 14
 
-// Size of QR code
-const qrsize = 400
-
 // If this list doesn't match what's registered below,
 // you're gonna have a bad time.
 var builtIns = []string{
 	"builtInhelp",
 	"builtInadmin",
+	"builtInreload",
+	"builtInjobs",
 	"builtIndump",
 	"builtInlogging",
+	"builtInhistory",
+	"builtInapproval",
+	"builtIngroups",
+	"builtInelevation",
 }
 
 func init() {
 	RegisterPlugin("builtIndump", PluginHandler{DefaultConfig: dumpConfig, Handler: dump})
 	RegisterPlugin("builtInhelp", PluginHandler{DefaultConfig: helpConfig, Handler: help})
 	RegisterPlugin("builtInadmin", PluginHandler{DefaultConfig: adminConfig, Handler: admin})
+	RegisterPlugin("builtInreload", PluginHandler{DefaultConfig: reloadConfig, Handler: reload})
+	RegisterPlugin("builtInjobs", PluginHandler{DefaultConfig: jobsConfig, Handler: jobs})
 	RegisterPlugin("builtInlogging", PluginHandler{DefaultConfig: logConfig, Handler: logging})
+	RegisterPlugin("builtInhistory", PluginHandler{DefaultConfig: historyConfig, Handler: history})
+	RegisterPlugin("builtInapproval", PluginHandler{DefaultConfig: approvalConfig, Handler: approval})
+	RegisterPlugin("builtIngroups", PluginHandler{DefaultConfig: groupsConfig, Handler: groups})
+	RegisterPlugin("builtInelevation", PluginHandler{DefaultConfig: elevationConfig, Handler: elevation})
 }
 
 /* builtin plugins, like help */
@@ -249,24 +258,45 @@ func logging(bot *Robot, command string, args ...string) (retval PlugRetVal) {
 	return
 }
 
-func admin(bot *Robot, command string, args ...string) (retval PlugRetVal) {
-	if command == "init" {
-		return // ignore init
+func reload(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	if command != "reload" {
+		return // ignore init, etc.
 	}
-	if !bot.CheckAdmin() {
-		bot.Reply("Sorry, only an admin user can request that")
+	err := loadConfig()
+	if err != nil {
+		bot.Reply("Error encountered during reload, check the logs")
+		Log(Error, fmt.Errorf("Reloading configuration, requested by %s: %v", bot.User, err))
 		return
 	}
+	bot.Reply("Configuration reloaded successfully")
+	Log(Info, "Configuration successfully reloaded by a request from:", bot.User)
+	return
+}
+
+func jobs(bot *Robot, command string, args ...string) (retval PlugRetVal) {
 	switch command {
-	case "reload":
-		err := loadConfig()
-		if err != nil {
-			bot.Reply("Error encountered during reload, check the logs")
-			Log(Error, fmt.Errorf("Reloading configuration, requested by %s: %v", bot.User, err))
+	case "listjobs":
+		running := listJobs()
+		jl := make([]string, 0, len(running))
+		for _, j := range running {
+			jl = append(jl, j.String())
+		}
+		bot.Fixed().Say(fmt.Sprintf("Here are the jobs I'm running:\n%s", strings.Join(jl, "\n")))
+	case "canceljob":
+		id, _ := strconv.Atoi(args[0])
+		j, ok := cancelJob(id, cancelAdmin)
+		if !ok {
+			bot.Reply(fmt.Sprintf("I don't have a job running with ID %d", id))
 			return
 		}
-		bot.Reply("Configuration reloaded successfully")
-		Log(Info, "Configuration successfully reloaded by a request from:", bot.User)
+		Log(Audit, fmt.Sprintf("User \"%s\" canceled job %d: plugin \"%s\", command \"%s\", user \"%s\"", bot.User, j.id, j.plugin, j.command, j.user))
+		bot.Reply(fmt.Sprintf("Ok, I've canceled job %d (plugin \"%s\", command \"%s\")", j.id, j.plugin, j.command))
+	}
+	return
+}
+
+func admin(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	switch command {
 	case "abort":
 		buf := make([]byte, 32768)
 		runtime.Stack(buf, true)
@@ -278,15 +308,21 @@ func admin(bot *Robot, command string, args ...string) (retval PlugRetVal) {
 		pluginsRunning.Lock()
 		pluginsRunning.count--
 		pluginsRunning.shuttingDown = true
+		pluginsRunning.Unlock()
+		// Let running Go plugins know we're shutting down
+		interruptJobs()
+		pluginsRunning.Lock()
 		if pluginsRunning.count > 0 {
 			runningCount := pluginsRunning.count
 			pluginsRunning.Unlock()
-			bot.Say(fmt.Sprintf("There are still %d plugins running; I'll exit when they all complete, or you can issue an \"abort\" command", runningCount))
+			bot.Say(fmt.Sprintf("There are still %d plugins running; I'll exit when they all complete, or you can \"list jobs\" and \"cancel job <id>\", or issue an \"abort\" command", runningCount))
 		} else {
 			pluginsRunning.Unlock()
 		}
 		// Wait for all plugins to stop running
 		pluginsRunning.Wait()
+		// Let plugins flush state before the brain goes away
+		shutdownPlugins()
 		bot.Reply(bot.RandomString(byebye))
 		// Stop the brain after it finishes any current task
 		brainQuit()
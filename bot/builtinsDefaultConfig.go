@@ -15,26 +15,131 @@ CommandMatchers:
 const adminConfig = `
 AllChannels: true
 AllowDirect: true
-RequireAdmin: true
+RequirePermission: ` + PermShutdown + `
 Help:
-- Keywords: [ "reload" ]
-  Helptext: [ "(bot), reload - have the robot reload configuration files" ]
 - Keywords: [ "quit" ]
   Helptext: [ "(bot), quit - request a graceful shutdown, waiting for all plugins to finish" ]
 - Keywords: [ "abort" ]
   Helptext: [ "(bot), abort - request an immediate shutdown without waiting for plugins to finish" ]
 CommandMatchers:
-- Command: reload
-  Regex: '(?i:reload)'
 - Command: quit
   Regex: '(?i:quit|exit)'
 - Command: abort
   Regex: '(?i:abort)'
 `
 
+const reloadConfig = `
+AllChannels: true
+AllowDirect: true
+RequirePermission: ` + PermReload + `
+Help:
+- Keywords: [ "reload" ]
+  Helptext: [ "(bot), reload - have the robot reload configuration files" ]
+CommandMatchers:
+- Command: reload
+  Regex: '(?i:reload)'
+`
+
+const jobsConfig = `
+AllChannels: true
+AllowDirect: true
+RequirePermission: ` + PermJobs + `
+Help:
+- Keywords: [ "jobs", "running", "list" ]
+  Helptext: [ "(bot), list jobs - list running plugin jobs" ]
+- Keywords: [ "jobs", "cancel", "kill" ]
+  Helptext: [ "(bot), cancel job <id> - cancel a running plugin job" ]
+CommandMatchers:
+- Command: listjobs
+  Regex: '(?i:(?:list |show )?(?:running )?jobs)'
+- Command: canceljob
+  Regex: '(?i:(?:cancel|kill) job (\d+))'
+`
+
+const historyConfig = `
+AllChannels: true
+AllowDirect: true
+Help:
+- Keywords: [ "history", "commands" ]
+  Helptext: [ "(bot), history - list your recent commands in this channel" ]
+- Keywords: [ "again", "repeat", "history" ]
+  Helptext: [ "(bot), !! | again - run your last command again" ]
+- Keywords: [ "again", "repeat", "history" ]
+  Helptext: [ "(bot), again with <old>/<new> - run your last command again, replacing <old> with <new>" ]
+CommandMatchers:
+- Command: history
+  Regex: '(?i:history)'
+- Command: again
+  Regex: '(?i:!!|again)'
+- Command: againwith
+  Regex: '(?i:again with ([^/]+)/(.*))'
+`
+
+const approvalConfig = `
+AllChannels: true
+AllowDirect: true
+Help:
+- Keywords: [ "approve", "approval", "request" ]
+  Helptext: [ "(bot), approve <number> - approve a pending request to run a command" ]
+- Keywords: [ "deny", "approval", "request" ]
+  Helptext: [ "(bot), deny <number> (<reason>) - deny a pending request to run a command" ]
+- Keywords: [ "approvals", "approval", "pending", "request" ]
+  Helptext: [ "(bot), approvals - list pending approval requests" ]
+CommandMatchers:
+- Command: approve
+  Regex: '(?i:approve (\d+))'
+- Command: deny
+  Regex: '(?i:deny (\d+)(?: (.+))?)'
+- Command: approvals
+  Regex: '(?i:(?:list )?(?:pending )?approvals)'
+`
+
+const groupsConfig = `
+AllChannels: true
+AllowDirect: true
+Help:
+- Keywords: [ "groups", "group", "list" ]
+  Helptext: [ "(bot), list groups - list the groups used for authorization" ]
+- Keywords: [ "group", "members", "show" ]
+  Helptext: [ "(bot), show group <group> - list the members of a group" ]
+- Keywords: [ "group", "add", "member" ]
+  Helptext: [ "(bot), add <user> to group <group> - add a user or nested group to a group (needs groups.manage)" ]
+- Keywords: [ "group", "remove", "member" ]
+  Helptext: [ "(bot), remove <user> from group <group> - remove a user or nested group from a group (needs groups.manage)" ]
+CommandMatchers:
+- Command: list
+  Regex: '(?i:list groups)'
+- Command: show
+  Regex: '(?i:show group ([\w.-]+))'
+- Command: add
+  Regex: '(?i:add @?([\w.-]+) to group ([\w.-]+))'
+- Command: remove
+  Regex: '(?i:remove @?([\w.-]+) from group ([\w.-]+))'
+`
+
+const elevationConfig = `
+AllChannels: true
+AllowDirect: true
+RequirePermission: ` + PermElevation + `
+Help:
+- Keywords: [ "elevation", "elevations", "sessions", "list" ]
+  Helptext: [ "(bot), list elevations - list active elevation sessions" ]
+- Keywords: [ "elevation", "elevations", "revoke" ]
+  Helptext: [ "(bot), revoke elevation for <user> - end a user's elevation sessions, so they have to authenticate again" ]
+- Keywords: [ "elevation", "elevations", "revoke" ]
+  Helptext: [ "(bot), revoke all elevations - end everybody's elevation sessions" ]
+CommandMatchers:
+- Command: list
+  Regex: '(?i:list elevations?(?: sessions?)?)'
+- Command: revokeall
+  Regex: '(?i:revoke all elevations?(?: sessions?)?)'
+- Command: revoke
+  Regex: '(?i:revoke elevations?(?: sessions?)? for @?([\w.@:-]+))'
+`
+
 const dumpConfig = `
 DirectOnly: true
-RequireAdmin: true
+RequirePermission: ` + PermPluginManage + `
 Help:
 - Keywords: [ "dump", "plugin" ]
   Helptext: [ "(bot), dump plugin (default) <plugname> - dump the current or default configuration for the plugin" ]
@@ -55,7 +160,7 @@ CommandMatchers:
 
 const logConfig = `
 DirectOnly: true
-RequireAdmin: true
+RequirePermission: ` + PermLogs + `
 Help:
 - Keywords: [ "log", "logs", "level" ]
   Helptext: [ "(bot), set log level to <trace|debug|info|warning|error> - adjust the logging verbosity" ]
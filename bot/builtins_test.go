@@ -0,0 +1,27 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+// Administrative builtins aren't available to users without the permission,
+// so they're not matched or suggested.
+func TestAdminCommandsRequirePermission(t *testing.T) {
+	tc := startTestRobot(t, rosterConf, nil, nil)
+	for _, cmd := range []string{"reload", "cancel job 1", "lsit jobs", "quit"} {
+		send("general", "bob", "floyd, "+cmd)
+		msg := tc.expect(t, "Sorry")
+		for _, admin := range []string{"reload", "jobs", "quit"} {
+			if strings.Contains(msg, admin) {
+				t.Errorf("User without permissions was offered \"%s\" for \"%s\": %s", admin, cmd, msg)
+			}
+		}
+	}
+	send("general", "root", "floyd, running jobs")
+	tc.expect(t, "Here are the jobs I'm running")
+	send("general", "root", "floyd, lsit jobs")
+	tc.expect(t, "list jobs - list running plugin jobs")
+	send("general", "root", "floyd, reload")
+	tc.expect(t, "Configuration reloaded successfully")
+}
@@ -2,6 +2,7 @@ package bot
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -10,8 +11,12 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
+// How long an external plugin has to exit after SIGTERM before it gets SIGKILL
+const killGracePeriod = 5 * time.Second
+
 // Windows argument parsing is all over the map; try to fix it here
 // Currently powershell only
 func fixInterpreterArgs(interpreter string, args []string) []string {
@@ -101,6 +106,7 @@ func getExtDefCfg(plugin *Plugin) (*[]byte, error) {
 		return nil, err
 	}
 	var cfg []byte
+	var cmd *exec.Cmd
 	if runtime.GOOS == "windows" {
 		var interpreter string
 		interpreter, err = getInterpreter(fullPath)
@@ -110,11 +116,19 @@ func getExtDefCfg(plugin *Plugin) (*[]byte, error) {
 		}
 		args := fixInterpreterArgs(interpreter, []string{fullPath, "configure"})
 		Log(Debug, fmt.Sprintf("Calling \"%s\" with args: %q", interpreter, args))
-		cfg, err = exec.Command(interpreter, args...).Output()
+		cmd = exec.Command(interpreter, args...)
 	} else {
 		Log(Debug, fmt.Sprintf("Calling \"%s\" with arg: configure", fullPath))
-		cfg, err = exec.Command(fullPath, "configure").Output()
+		cmd = exec.Command(fullPath, "configure")
+	}
+	if plugin.sandbox != nil {
+		cleanup, err := sandboxCommand(cmd, plugin.name, plugin.sandbox)
+		if err != nil {
+			return nil, fmt.Errorf("Problem sandboxing external plugin \"%s\" for default configuration, skipping: %v", fullPath, err)
+		}
+		defer cleanup()
 	}
+	cfg, err = cmd.Output()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			err = fmt.Errorf("Problem retrieving default configuration for external plugin \"%s\", skipping: \"%v\", output: %s", fullPath, err, exitErr.Stderr)
@@ -126,6 +140,22 @@ func getExtDefCfg(plugin *Plugin) (*[]byte, error) {
 	return &cfg, nil
 }
 
+// commandTimeout returns how long a plugin may run a given command;
+// a Timeout on a matcher for the command overrides the plugin's Timeout.
+func (plugin *Plugin) commandTimeout(command string) time.Duration {
+	if isLifecycleHook(command) {
+		return plugin.hookTimeout()
+	}
+	for _, matchers := range [][]InputMatcher{plugin.CommandMatchers, plugin.MessageMatchers} {
+		for _, matcher := range matchers {
+			if matcher.Command == command && matcher.Timeout > 0 {
+				return time.Duration(matcher.Timeout) * time.Second
+			}
+		}
+	}
+	return time.Duration(plugin.Timeout) * time.Second
+}
+
 // callPlugin (normally called with go ...) sends a command to a plugin.
 func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, command string, args ...string) (retval PlugRetVal) {
 	if background {
@@ -142,6 +172,36 @@ func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, c
 			pluginsRunning.Unlock()
 		}()
 	}
+	j, ctx := startJob(bot, plugin, command)
+	defer j.finish()
+	// Builtins are never queued, so admins can always list and cancel jobs
+	if background && plugin.pluginType != plugBuiltin {
+		release, ok := acquireJobSlot(ctx, bot, plugin, interactive, command)
+		if !ok && ctx.Err() == nil {
+			// the reason has already been logged, and the user told if
+			// they asked for the job
+			return
+		}
+		if ok {
+			defer release()
+		}
+	}
+	if ctx.Err() != nil {
+		reason := j.cancelReason()
+		Log(Warn, fmt.Sprintf("Queued job %d for plugin \"%s\" command \"%s\" was canceled %s before it ran", j.id, plugin.name, command, reason))
+		if interactive {
+			bot.Reply(fmt.Sprintf("Sorry, your queued \"%s\" command was canceled %s", command, reason))
+		}
+		return Canceled
+	}
+	// Each call gets it's own copy of the Robot, so setting the pluginID and
+	// context doesn't clobber the caller's.
+	nb := *bot
+	bot = &nb
+	timeout := plugin.commandTimeout(command)
+	ctx, rctx := j.run(ctx, timeout)
+	bot.ctx = rctx
+	bot.interrupt = j.interrupt
 	var errString string
 	defer func() {
 		if interactive && errString != "" {
@@ -155,7 +215,15 @@ func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, c
 	bot.pluginID = plugin.pluginID
 	switch plugin.pluginType {
 	case plugBuiltin, plugGo:
-		return pluginHandlers[plugin.name].Handler(bot, command, args...)
+		retval = pluginHandlers[plugin.name].Handler(bot, command, args...)
+		// Go plugins can't be killed, but they should have returned early
+		// when their context was cancelled.
+		if ctx.Err() == context.DeadlineExceeded {
+			Log(Error, fmt.Sprintf("Go plugin \"%s\" exceeded timeout of %v running command \"%s\" for user \"%s\" in channel \"%s\", returning TimedOut (%d)", plugin.name, timeout, command, bot.User, bot.Channel, TimedOut))
+			errString = fmt.Sprintf("Sorry, the \"%s\" command took longer than %v and was stopped", command, timeout)
+			return TimedOut
+		}
+		return retval
 	case plugExternal:
 		var fullPath string // full path to the executable
 		var err error
@@ -188,8 +256,23 @@ func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, c
 		cmd.Env = append(os.Environ(), []string{
 			fmt.Sprintf("GOPHER_CHANNEL=%s", bot.Channel),
 			fmt.Sprintf("GOPHER_USER=%s", bot.User),
+			fmt.Sprintf("GOPHER_CANONICAL_USER=%s", bot.CanonicalUser()),
 			fmt.Sprintf("GOPHER_PLUGIN_ID=%s", plugin.pluginID),
 		}...)
+		cmd.Env = append(cmd.Env, argsEnv(bot.args)...)
+		cmd.Env = append(cmd.Env, annotationsEnv(bot.annotations)...)
+		// run the plugin in it's own process group, so a timeout can kill
+		// everything it started
+		setProcGroup(cmd)
+		if plugin.sandbox != nil {
+			cleanup, err := sandboxCommand(cmd, plugin.name, plugin.sandbox)
+			if err != nil {
+				Log(Error, fmt.Errorf("Sandboxing external plugin \"%s\": %v", plugin.name, err))
+				errString = fmt.Sprintf("There were errors calling external plugin \"%s\", you might want to ask an administrator to check the logs", plugin.name)
+				return MechanismFail
+			}
+			defer cleanup()
+		}
 		// close stdout on the external plugin...
 		cmd.Stdout = nil
 		// but hold on to stderr in case we need to log an error
@@ -204,6 +287,23 @@ func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, c
 			errString = fmt.Sprintf("There were errors calling external plugin \"%s\", you might want to ask an administrator to check the logs", plugin.name)
 			return MechanismFail
 		}
+		// Stop the plugin if the job times out or is canceled
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-exited:
+				return
+			case <-ctx.Done():
+			}
+			Log(Warn, fmt.Sprintf("Stopping external plugin \"%s\" running command \"%s\" (job %d): %v; sending SIGTERM", plugin.name, command, j.id, ctx.Err()))
+			termProcGroup(cmd)
+			select {
+			case <-exited:
+			case <-time.After(killGracePeriod):
+				Log(Warn, fmt.Sprintf("External plugin \"%s\" didn't exit within %v of SIGTERM, sending SIGKILL", plugin.name, killGracePeriod))
+				killProcGroup(cmd)
+			}
+		}()
 		var stdErrBytes []byte
 		if stdErrBytes, err = ioutil.ReadAll(stderr); err != nil {
 			Log(Error, fmt.Errorf("Reading from stderr for external command \"%s\": %v", fullPath, err))
@@ -215,7 +315,20 @@ func callPlugin(bot *Robot, plugin *Plugin, background bool, interactive bool, c
 			Log(Warn, fmt.Errorf("Output from stderr of external command \"%s\": %s", fullPath, stdErrString))
 			errString = fmt.Sprintf("There was error output while calling external plugin \"%s\", you might want to ask an administrator to check the logs", plugin.name)
 		}
-		if err = cmd.Wait(); err != nil {
+		err = cmd.Wait()
+		close(exited)
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			Log(Error, fmt.Sprintf("External plugin \"%s\" timed out after %v running command \"%s\" for user \"%s\" in channel \"%s\", returning TimedOut (%d)", plugin.name, timeout, command, bot.User, bot.Channel, TimedOut))
+			errString = fmt.Sprintf("Sorry, the \"%s\" command took longer than %v and was stopped", command, timeout)
+			return TimedOut
+		case context.Canceled:
+			reason := j.cancelReason()
+			Log(Warn, fmt.Sprintf("External plugin \"%s\" running command \"%s\" for user \"%s\" in channel \"%s\" was canceled %s (job %d), returning Canceled (%d)", plugin.name, command, bot.User, bot.Channel, reason, j.id, Canceled))
+			errString = fmt.Sprintf("Sorry, your \"%s\" command was canceled %s", command, reason)
+			return Canceled
+		}
+		if err != nil {
 			Log(Error, fmt.Errorf("Waiting on external command \"%s\": %v", fullPath, err))
 			errString = fmt.Sprintf("There were errors calling external plugin \"%s\", you might want to ask an administrator to check the logs", plugin.name)
 			if exitstatus, ok := err.(*exec.ExitError); ok {
@@ -16,30 +16,45 @@ import (
 var protocolConfig, brainConfig, elevateConfig json.RawMessage
 
 type externalPlugin struct {
-	Name, Path string // List of names and paths for external plugins; relative paths are searched first in installdir, then localdir
+	Name, Path string   // List of names and paths for external plugins; relative paths are searched first in installdir, then localdir
+	Sandbox    *Sandbox // Optional restrictions on the plugin's process, Linux only
 }
 
 // botconf specifies 'bot configuration, and is read from $GOPHER_CONFIGDIR/conf/gopherbot.yaml
 type botconf struct {
-	AdminContact       string           // Contact info for whomever administers the robot
-	Email              string           // From: address when the robot wants to send an email
-	MailConfig         botMailer        // configuration for sending email
-	Protocol           string           // Name of the connector protocol to use, e.g. "slack"
-	ProtocolConfig     json.RawMessage  // Protocol-specific configuration, type for unmarshalling arbitrary config
-	Brain              string           // Type of Brain to use
-	BrainConfig        json.RawMessage  // Brain-specific configuration, type for unmarshalling arbitrary config
-	DefaultElevator    string           // Elevator plugin to use by default for ElevatedCommands and ElevateImmediateCommands
-	DefaultAuthorizer  string           // Authorizer plugin to use by default for AuthorizedCommands, or when AuthorizeAllCommands = true
-	Name               string           // Name of the 'bot, specify here if the protocol doesn't supply it (slack does)
-	DefaultAllowDirect bool             // Whether plugins are available in a DM by default
-	DefaultChannels    []string         // Channels where plugins are active by default, e.g. [ "general", "random" ]
-	IgnoreUsers        []string         // Users the 'bot never talks to - like other bots
-	JoinChannels       []string         // Channels the 'bot should join when it logs in (not supported by all protocols)
-	ExternalPlugins    []externalPlugin // List of non-Go plugins to load
-	AdminUsers         []string         // List of users who can access administrative commands
-	Alias              string           // One-character alias for commands directed at the 'bot, e.g. ';open the pod bay doors'
-	LocalPort          int              // Port number for listening on localhost, for CLI plugins
-	LogLevel           string           // Initial log level, can be modified by plugins. One of "trace" "debug" "info" "warn" "error"
+	AdminContact            string              // Contact info for whomever administers the robot
+	Email                   string              // From: address when the robot wants to send an email
+	MailConfig              botMailer           // configuration for sending email
+	Protocol                string              // Name of the connector protocol to use, e.g. "slack"
+	ProtocolConfig          json.RawMessage     // Protocol-specific configuration, type for unmarshalling arbitrary config
+	Brain                   string              // Type of Brain to use
+	BrainConfig             json.RawMessage     // Brain-specific configuration, type for unmarshalling arbitrary config
+	DefaultElevator         string              // Elevator plugin to use by default for ElevatedCommands and ElevateImmediateCommands
+	DefaultAuthorizer       string              // Authorizer plugin to use by default for AuthorizedCommands, or when AuthorizeAllCommands = true
+	Name                    string              // Name of the 'bot, specify here if the protocol doesn't supply it (slack does)
+	DefaultAllowDirect      bool                // Whether plugins are available in a DM by default
+	DefaultChannels         []string            // Channels where plugins are active by default, e.g. [ "general", "random" ]
+	IgnoreUsers             []string            // Users the 'bot never talks to - like other bots
+	JoinChannels            []string            // Channels the 'bot should join when it logs in (not supported by all protocols)
+	ExternalPlugins         []externalPlugin    // List of non-Go plugins to load
+	AdminUsers              []string            // List of users who can access administrative commands
+	Alias                   string              // One-character alias for commands directed at the 'bot, e.g. ';open the pod bay doors'
+	LocalPort               int                 // Port number for listening on localhost, for CLI plugins
+	MaxConcurrentPlugins    int                 // Maximum number of plugin jobs to run at once; more are queued. 0 = unlimited
+	QueuedReply             string              // Reply when a job is queued; (count) is replaced with the number of jobs ahead of it
+	RateLimits              []RateLimit         // Robot-wide limits on how often commands can be run
+	RateLimitReply          string              // Reply when a command is rate limited; (wait) is replaced with how long to wait
+	Middleware              []string            // Go middleware and external filter plugins to run on incoming messages, in order
+	HistorySize             int                 // Number of commands to remember per user and channel; default 10, -1 disables history
+	HistoryInBrain          bool                // Keep command history in the brain, so it survives a restart
+	ApprovalChannel         string              // Channel where requests for ApprovalCommands are posted; default is the requesting channel
+	ApprovalGroups          map[string][]string // Deprecated, approval groups should be defined in Groups
+	ApprovalTimeout         int                 // Seconds to wait for approval before a request expires; default 900
+	Groups                  map[string][]string // Groups of users (and other groups) for the builtin group authorizer
+	Roles                   map[string]Role     // Roles granting named permissions to users and groups
+	UserRoster              map[string]UserInfo // Attributes for users, supplementing those from the protocol
+	UserAttributePrecedence string              // "protocol" (default) or "roster" - which user attributes win when both are present
+	LogLevel                string              // Initial log level, can be modified by plugins. One of "trace" "debug" "info" "warn" "error"
 }
 
 var config *botconf
@@ -123,23 +138,35 @@ func loadConfig() error {
 		var sarrval []string
 		var epval []externalPlugin
 		var mailval botMailer
+		var rlval []RateLimit
+		var groupval map[string][]string
+		var roleval map[string]Role
+		var rosterval map[string]UserInfo
 		var boolval bool
 		var intval int
 		var val interface{}
 		skip := false
 		switch key {
-		case "AdminContact", "Email", "Protocol", "Brain", "DefaultElevator", "DefaultAuthorizer", "Name", "Alias", "LogLevel":
+		case "AdminContact", "Email", "Protocol", "Brain", "DefaultElevator", "DefaultAuthorizer", "Name", "Alias", "LogLevel", "QueuedReply", "RateLimitReply", "ApprovalChannel", "UserAttributePrecedence":
 			val = &strval
-		case "DefaultAllowDirect":
+		case "DefaultAllowDirect", "HistoryInBrain":
 			val = &boolval
-		case "LocalPort":
+		case "LocalPort", "MaxConcurrentPlugins", "HistorySize", "ApprovalTimeout":
 			val = &intval
 		case "ExternalPlugins":
 			val = &epval
-		case "DefaultChannels", "IgnoreUsers", "JoinChannels", "AdminUsers":
+		case "DefaultChannels", "IgnoreUsers", "JoinChannels", "AdminUsers", "Middleware":
 			val = &sarrval
 		case "MailConfig":
 			val = &mailval
+		case "RateLimits":
+			val = &rlval
+		case "ApprovalGroups", "Groups":
+			val = &groupval
+		case "Roles":
+			val = &roleval
+		case "UserRoster":
+			val = &rosterval
 		case "ProtocolConfig", "BrainConfig":
 			skip = true
 		default:
@@ -187,15 +214,74 @@ func loadConfig() error {
 			newconfig.ExternalPlugins = *(val.(*[]externalPlugin))
 		case "AdminUsers":
 			newconfig.AdminUsers = *(val.(*[]string))
+		case "Middleware":
+			newconfig.Middleware = *(val.(*[]string))
 		case "Alias":
 			newconfig.Alias = *(val.(*string))
 		case "LocalPort":
 			newconfig.LocalPort = *(val.(*int))
 		case "LogLevel":
 			newconfig.LogLevel = *(val.(*string))
+		case "MaxConcurrentPlugins":
+			newconfig.MaxConcurrentPlugins = *(val.(*int))
+		case "HistorySize":
+			newconfig.HistorySize = *(val.(*int))
+		case "HistoryInBrain":
+			newconfig.HistoryInBrain = *(val.(*bool))
+		case "QueuedReply":
+			newconfig.QueuedReply = *(val.(*string))
+		case "RateLimits":
+			newconfig.RateLimits = *(val.(*[]RateLimit))
+		case "RateLimitReply":
+			newconfig.RateLimitReply = *(val.(*string))
+		case "ApprovalChannel":
+			newconfig.ApprovalChannel = *(val.(*string))
+		case "ApprovalGroups":
+			newconfig.ApprovalGroups = *(val.(*map[string][]string))
+		case "ApprovalTimeout":
+			newconfig.ApprovalTimeout = *(val.(*int))
+		case "Groups":
+			newconfig.Groups = *(val.(*map[string][]string))
+		case "Roles":
+			newconfig.Roles = *(val.(*map[string]Role))
+		case "UserRoster":
+			newconfig.UserRoster = *(val.(*map[string]UserInfo))
+		case "UserAttributePrecedence":
+			newconfig.UserAttributePrecedence = *(val.(*string))
 		}
 	}
 
+	for _, rl := range newconfig.RateLimits {
+		if err := rl.validate(); err != nil {
+			err = fmt.Errorf("Invalid RateLimits in gopherbot.yaml: %v", err)
+			Log(Error, err)
+			return err
+		}
+	}
+
+	for name, role := range newconfig.Roles {
+		for _, group := range role.Groups {
+			if _, ok := newconfig.Groups[group]; !ok {
+				err := fmt.Errorf("Invalid Roles in gopherbot.yaml: role \"%s\" grants permissions to undefined group \"%s\"", name, group)
+				Log(Error, err)
+				return err
+			}
+		}
+	}
+
+	if err := validPrecedence(newconfig.UserAttributePrecedence); err != nil {
+		err = fmt.Errorf("Invalid configuration in gopherbot.yaml: %v", err)
+		Log(Error, err)
+		return err
+	}
+
+	userIDs, err := userIDMap(newconfig.UserRoster, newconfig.Protocol)
+	if err != nil {
+		err = fmt.Errorf("Invalid UserRoster in gopherbot.yaml: %v", err)
+		Log(Error, err)
+		return err
+	}
+
 	loglevel = logStrToLevel(newconfig.LogLevel)
 	setLogLevel(loglevel)
 
@@ -209,6 +295,21 @@ func loadConfig() error {
 		robot.email = newconfig.Email
 	}
 	robot.mailConf = newconfig.MailConfig
+	robot.maxConcurrent = newconfig.MaxConcurrentPlugins // defaults to 0, unlimited
+	robot.queuedReply = newconfig.QueuedReply
+	robot.rateLimits = newconfig.RateLimits
+	robot.rateLimitReply = newconfig.RateLimitReply
+	robot.middleware = newconfig.Middleware
+	robot.historySize = newconfig.HistorySize
+	robot.historyInBrain = newconfig.HistoryInBrain
+	robot.approvalChannel = newconfig.ApprovalChannel
+	robot.approvalGroups = newconfig.ApprovalGroups
+	robot.approvalTimeout = newconfig.ApprovalTimeout
+	robot.groups = newconfig.Groups
+	robot.roles = newconfig.Roles
+	robot.userRoster = newconfig.UserRoster
+	robot.attrPrecedence = newconfig.UserAttributePrecedence
+	robot.userIDs = userIDs
 	if newconfig.Alias != "" {
 		alias, _ := utf8.DecodeRuneInString(newconfig.Alias)
 		if !strings.ContainsRune(string(aliases+escapeAliases), alias) {
@@ -267,6 +368,12 @@ func loadConfig() error {
 				pluginsOk = false
 				Log(Error, fmt.Errorf("Reading external plugins, zero-length Name or Path for plugin #%d, not reloading plugins", i))
 			}
+			if ep.Sandbox != nil {
+				if err := ep.Sandbox.validate(); err != nil {
+					pluginsOk = false
+					Log(Error, fmt.Errorf("Reading external plugins, invalid Sandbox for plugin \"%s\", not reloading plugins: %v", ep.Name, err))
+				}
+			}
 		}
 		if pluginsOk {
 			robot.externalPlugins = newconfig.ExternalPlugins
@@ -0,0 +1,90 @@
+package bot
+
+/* confirm.go - asking the user "are you sure?" before running commands
+   listed in a plugin's ConfirmCommands. */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// default confirmation prompt; (command) is replaced with the command name,
+// and (args) with the arguments
+const defaultConfirmPrompt = "You asked me to run \"(command)\" with arguments: (args) - are you sure? (yes/no)"
+
+// hasCommand checks whether a command is defined in the plugin's
+// CommandMatchers or MessageMatchers
+func (plugin *Plugin) hasCommand(command string) bool {
+	for _, matchers := range [][]InputMatcher{plugin.CommandMatchers, plugin.MessageMatchers} {
+		for _, matcher := range matchers {
+			if matcher.Command == command {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// describeArgs formats command arguments for a confirmation prompt, using
+// the names of named capture groups where there are any.
+func describeArgs(matcher InputMatcher, cmdArgs []string) string {
+	var names []string
+	if matcher.re != nil {
+		names = matcher.re.SubexpNames()
+	}
+	described := make([]string, 0, len(cmdArgs))
+	for i, arg := range cmdArgs {
+		if arg == "" {
+			continue
+		}
+		if i+1 < len(names) && names[i+1] != "" {
+			described = append(described, fmt.Sprintf("%s=%s", names[i+1], arg))
+		} else {
+			described = append(described, fmt.Sprintf("\"%s\"", arg))
+		}
+	}
+	if len(described) == 0 {
+		return "(none)"
+	}
+	return strings.Join(described, ", ")
+}
+
+// checkConfirmation prompts the user to confirm a command listed in the
+// plugin's ConfirmCommands, returning Success if they replied yes.
+func (bot *Robot) checkConfirmation(plugin *Plugin, matcher InputMatcher, cmdArgs []string) (retval PlugRetVal) {
+	confirm := false
+	for _, c := range plugin.ConfirmCommands {
+		if c == matcher.Command {
+			confirm = true
+			break
+		}
+	}
+	if !confirm {
+		return Success
+	}
+	prompt := plugin.ConfirmPrompt
+	if prompt == "" {
+		prompt = defaultConfirmPrompt
+	}
+	prompt = strings.Replace(prompt, "(command)", matcher.Command, -1)
+	prompt = strings.Replace(prompt, "(args)", describeArgs(matcher, cmdArgs), -1)
+	rep, ret := bot.PromptForReply("YesNo", prompt)
+	switch ret {
+	case Ok:
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(rep)), "y") {
+			Log(Info, fmt.Sprintf("User \"%s\" confirmed command \"%s\" for plugin \"%s\" in channel \"%s\"", bot.User, matcher.Command, plugin.name, bot.Channel))
+			return Success
+		}
+		bot.Reply(fmt.Sprintf("Ok, I won't run \"%s\"", matcher.Command))
+	case TimeoutExpired:
+		bot.Reply(fmt.Sprintf("I didn't get a yes or no, so I'm not running \"%s\"", matcher.Command))
+	case ReplyNotMatched, UseDefaultValue:
+		bot.Reply(fmt.Sprintf("That wasn't a yes or no, so I'm not running \"%s\"", matcher.Command))
+	case Interrupted:
+		// the user moved on to another command, or cancelled with '-'
+	default:
+		Log(Error, fmt.Sprintf("Unexpected return value prompting user \"%s\" to confirm command \"%s\": %s", bot.User, matcher.Command, ret))
+	}
+	Log(Debug, fmt.Sprintf("Command \"%s\" for plugin \"%s\" not confirmed by user \"%s\"", matcher.Command, plugin.name, bot.User))
+	return Fail
+}
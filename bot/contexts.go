@@ -0,0 +1,176 @@
+package bot
+
+/* contexts.go - resolving "it", "that server", "the last link" and the like
+   from short-term memories, and making sure the command still matches with
+   the remembered values substituted in. */
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
+)
+
+// words that make a reference to a context, e.g. "that server"
+var contextPrefixes = []string{"that ", "this ", "the ", "the last ", "the same "}
+
+// isContextReference returns true when a captured argument refers back to
+// a remembered context: an empty (optional) group, "it", or a pronoun-style
+// reference to the label such as "that server" or "the last link".
+func isContextReference(arg, label string) bool {
+	// normalize case and whitespace, so this is a simple comparison
+	ref := strings.Join(strings.Fields(arg), " ")
+	if ref == "" || strings.EqualFold(ref, "it") {
+		return true
+	}
+	for _, prefix := range contextPrefixes {
+		if strings.EqualFold(ref, prefix+label) {
+			return true
+		}
+	}
+	return false
+}
+
+// findCapture returns the parsed sub-expression for capture group n
+func findCapture(re *syntax.Regexp, n int) *syntax.Regexp {
+	if re.Op == syntax.OpCapture && re.Cap == n {
+		return re.Sub[0]
+	}
+	for _, sub := range re.Sub {
+		if found := findCapture(sub, n); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// groupMatches checks that a value could have been captured by group n of
+// a matcher regex.
+func groupMatches(re *regexp.Regexp, n int, value string) bool {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return false
+	}
+	group := findCapture(parsed, n)
+	if group == nil {
+		return false
+	}
+	gre, err := regexp.Compile(`^(?:` + group.String() + `)$`)
+	if err != nil {
+		return false
+	}
+	return gre.MatchString(value)
+}
+
+// revalidateContexts substitutes resolved context values back in to the
+// message and re-runs the matcher, returning the new arguments. When a value
+// is for an optional group that didn't match, there's nowhere to substitute
+// it, so the value is only checked against the group's own regex.
+func revalidateContexts(matcher InputMatcher, message string, cmdArgs []string, resolved map[int]string) ([]string, bool) {
+	for i, value := range resolved {
+		if !groupMatches(matcher.re, i+1, value) {
+			Log(Debug, fmt.Sprintf("Remembered value \"%s\" doesn't match capture group %d of \"%s\"", value, i+1, matcher.re.String()))
+			return nil, false
+		}
+	}
+	idx := matcher.re.FindStringSubmatchIndex(message)
+	if idx == nil {
+		return nil, false
+	}
+	groups := make([]int, 0, len(resolved))
+	for i := range resolved {
+		groups = append(groups, i)
+	}
+	sort.Slice(groups, func(a, b int) bool { return idx[2*(groups[a]+1)] < idx[2*(groups[b]+1)] })
+	splice := true
+	last := 0
+	for _, i := range groups {
+		start, end := idx[2*(i+1)], idx[2*(i+1)+1]
+		if start < last {
+			// absent or nested groups
+			splice = false
+			break
+		}
+		last = end
+	}
+	if !splice {
+		for i, value := range resolved {
+			cmdArgs[i] = value
+		}
+		return cmdArgs, true
+	}
+	rebuilt := ""
+	last = 0
+	for _, i := range groups {
+		start, end := idx[2*(i+1)], idx[2*(i+1)+1]
+		rebuilt += message[last:start] + resolved[i]
+		last = end
+	}
+	rebuilt += message[last:]
+	matches := matcher.re.FindStringSubmatch(rebuilt)
+	if matches == nil {
+		Log(Debug, fmt.Sprintf("Message \"%s\" no longer matches \"%s\" after substituting contexts", rebuilt, matcher.re.String()))
+		return nil, false
+	}
+	Log(Debug, fmt.Sprintf("Re-matched command \"%s\" with contexts substituted: \"%s\"", matcher.Command, rebuilt))
+	return matches[1:], true
+}
+
+// resolveContexts fills in arguments that refer to remembered contexts, and
+// remembers the ones that were given. It returns ok = false, after telling
+// the user, when a context can't be resolved.
+func resolveContexts(bot *Robot, m pluginMatch) (cmdArgs []string, ok bool) {
+	matcher := m.matcher
+	cmdArgs = m.cmdArgs
+	if len(matcher.Contexts) == 0 {
+		return cmdArgs, true
+	}
+	ts := time.Now()
+	resolved := make(map[int]string)
+	shortTermMemories.Lock()
+	for i, contextLabel := range matcher.Contexts {
+		if contextLabel == "" || i >= len(cmdArgs) {
+			continue
+		}
+		if isContextReference(cmdArgs[i], contextLabel) {
+			c := memoryContext{"context:" + contextLabel, bot.User, bot.Channel}
+			s, exists := shortTermMemories.m[c]
+			if !exists {
+				shortTermMemories.Unlock()
+				bot.Say(fmt.Sprintf("Sorry, I don't remember which %s we were talking about - please re-enter your command and be more specific", contextLabel))
+				return nil, false
+			}
+			resolved[i] = s.memory
+			s.timestamp = ts
+			shortTermMemories.m[c] = s
+		}
+	}
+	shortTermMemories.Unlock()
+	if len(resolved) > 0 {
+		var valid bool
+		if cmdArgs, valid = revalidateContexts(matcher, m.message, cmdArgs, resolved); !valid {
+			labels := make([]string, 0, len(resolved))
+			for i := range resolved {
+				labels = append(labels, fmt.Sprintf("%s \"%s\"", matcher.Contexts[i], resolved[i]))
+			}
+			sort.Strings(labels)
+			bot.Say(fmt.Sprintf("Sorry, the %s I remember doesn't work with that command - please re-enter your command and be more specific", strings.Join(labels, " and ")))
+			return nil, false
+		}
+	}
+	shortTermMemories.Lock()
+	for i, contextLabel := range matcher.Contexts {
+		if contextLabel == "" || i >= len(cmdArgs) || cmdArgs[i] == "" {
+			continue
+		}
+		if _, wasResolved := resolved[i]; wasResolved {
+			continue
+		}
+		c := memoryContext{"context:" + contextLabel, bot.User, bot.Channel}
+		shortTermMemories.m[c] = shortTermMemory{cmdArgs[i], ts}
+	}
+	shortTermMemories.Unlock()
+	return cmdArgs, true
+}
@@ -0,0 +1,42 @@
+package bot_test
+
+/* defaultplugins_test.go - tests with the same Go plugins main.go compiles
+   in. */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/uva-its/gopherbot/bot"
+
+	_ "github.com/uva-its/gopherbot/goplugins/duo"
+	_ "github.com/uva-its/gopherbot/goplugins/emailotp"
+	_ "github.com/uva-its/gopherbot/goplugins/help"
+	_ "github.com/uva-its/gopherbot/goplugins/knock"
+	_ "github.com/uva-its/gopherbot/goplugins/ldapcheck"
+	_ "github.com/uva-its/gopherbot/goplugins/links"
+	_ "github.com/uva-its/gopherbot/goplugins/lists"
+	_ "github.com/uva-its/gopherbot/goplugins/meme"
+	_ "github.com/uva-its/gopherbot/goplugins/ping"
+	_ "github.com/uva-its/gopherbot/goplugins/totp"
+)
+
+const defaultConf = `
+Name: floyd
+Protocol: test
+DefaultChannels: [ "general" ]
+AdminUsers: [ "root" ]
+`
+
+// With the help plugin's catchall loaded, near misses still get
+// suggestions, and only commands with nothing to suggest go to the catchall.
+func TestSuggestWithHelpCatchAll(t *testing.T) {
+	tc := bot.StartTestRobot(t, defaultConf, nil, nil)
+	bot.Send("general", "alice", "floyd, histroy")
+	reply := tc.Expect(t, "did you mean")
+	if !strings.Contains(reply, "floyd, history") {
+		t.Errorf("Suggestions for \"histroy\" don't include history: %s", reply)
+	}
+	bot.Send("general", "alice", "floyd, xyzzy plugh")
+	tc.Expect(t, "didn't match any commands I know")
+}
@@ -0,0 +1,77 @@
+package bot
+
+/* disambiguate.go - when a command matches more than one plugin, matcher
+   priorities are used to pick one, or failing that the user is asked. */
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a pluginMatch is a plugin command matcher that matched a message, along
+// with the arguments from the capture groups
+type pluginMatch struct {
+	plugin  *Plugin
+	matcher InputMatcher
+	cmdArgs []string
+	message string // the message that matched, for re-matching after context substitution
+	command bool   // true for CommandMatchers, false for MessageMatchers
+}
+
+// highestPriority returns only the matches with the highest matcher Priority
+func highestPriority(matches []pluginMatch) []pluginMatch {
+	if len(matches) < 2 {
+		return matches
+	}
+	max := matches[0].matcher.Priority
+	for _, m := range matches[1:] {
+		if m.matcher.Priority > max {
+			max = m.matcher.Priority
+		}
+	}
+	top := make([]pluginMatch, 0, len(matches))
+	for _, m := range matches {
+		if m.matcher.Priority == max {
+			top = append(top, m)
+		}
+	}
+	return top
+}
+
+// disambiguate asks the user which of several matching commands they meant,
+// then runs the one chosen. It runs in it's own goroutine, since the reply
+// comes back through handleMessage.
+func disambiguate(bot *Robot, plugins []*Plugin, matches []pluginMatch, messagetext string) {
+	defer checkPanic(bot, messagetext)
+	prompt := make([]string, 0, len(matches)+2)
+	prompt = append(prompt, "Your command matched more than one plugin - which did you mean?")
+	for i, m := range matches {
+		prompt = append(prompt, fmt.Sprintf("%d: plugin \"%s\", command \"%s\"", i+1, m.plugin.name, m.matcher.Command))
+	}
+	prompt = append(prompt, "Reply with a number, or '-' to cancel")
+	rep, ret := bot.PromptForReply("Number", strings.Join(prompt, "\n"))
+	switch ret {
+	case Ok:
+	case Interrupted:
+		Log(Debug, fmt.Sprintf("User \"%s\" cancelled choosing a plugin for command \"%s\"", bot.User, messagetext))
+		return
+	case TimeoutExpired:
+		bot.Reply("I didn't hear back which command you meant, so I'm not doing anything")
+		return
+	case ReplyNotMatched, UseDefaultValue:
+		bot.Reply("Sorry, that's not one of the choices - please re-enter your command")
+		return
+	default:
+		Log(Error, fmt.Sprintf("Unexpected return value prompting user \"%s\" to choose a plugin: %s", bot.User, ret))
+		return
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(rep))
+	if err != nil || choice < 1 || choice > len(matches) {
+		bot.Reply("Sorry, that's not one of the choices - please re-enter your command")
+		return
+	}
+	m := matches[choice-1]
+	Log(Debug, fmt.Sprintf("User \"%s\" chose plugin \"%s\", command \"%s\" for \"%s\"", bot.User, m.plugin.name, m.matcher.Command, messagetext))
+	runMatch(bot, plugins, m)
+}
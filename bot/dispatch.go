@@ -3,6 +3,7 @@ package bot
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,6 +13,8 @@ var pluginsRunning struct {
 	sync.WaitGroup
 	paused       bool
 	shuttingDown bool
+	jobs         map[int]*job // all running plugin jobs, see jobs.go
+	nextJobID    int
 	sync.Mutex
 }
 
@@ -44,19 +47,15 @@ func pluginAvailable(user, channel string, plugin *Plugin) bool {
 		Log(Error, fmt.Sprintf("Plugin %s has conflicting DirectOnly and DenyDirect both true", plugin.name))
 		return false
 	}
-	if plugin.RequireAdmin {
-		isAdmin := false
-		robot.RLock()
-		for _, adminUser := range robot.adminUsers {
-			if user == adminUser {
-				isAdmin = true
-				break
-			}
-		}
-		robot.RUnlock()
-		if !isAdmin {
-			return false
-		}
+	if plugin.RequireAdmin || plugin.RequirePermission != "" || len(plugin.Users) > 0 {
+		// access lists are evaluated against the canonical identity
+		user = canonicalUser(user)
+	}
+	if plugin.RequireAdmin && !isAdmin(user) {
+		return false
+	}
+	if plugin.RequirePermission != "" && !hasPermission(user, plugin.RequirePermission) {
+		return false
 	}
 	if len(plugin.Users) > 0 {
 		userOk := false
@@ -89,7 +88,9 @@ func pluginAvailable(user, channel string, plugin *Plugin) bool {
 
 // checkPluginMatchersAndRun checks either command matchers (for messages directed at
 // the robot), or message matchers (for ambient commands that need not be
-// directed at the robot), and calls the plugin if it matches. Note: this
+// directed at the robot), and calls the plugin if it matches. When a command
+// matches more than one plugin, matchers with the highest Priority win; if
+// that still leaves more than one, the user is asked to choose. Note: this
 // function is called under a read lock on the 'b' struct.
 func checkPluginMatchersAndRun(checkCommands bool, bot *Robot, messagetext string) (commandMatched bool) {
 	// un-needed, but more clear
@@ -97,9 +98,7 @@ func checkPluginMatchersAndRun(checkCommands bool, bot *Robot, messagetext strin
 	currentPlugins.RLock()
 	plugins := currentPlugins.p
 	currentPlugins.RUnlock()
-	var runPlugin *Plugin
-	var matchedMatcher InputMatcher
-	var cmdArgs []string
+	var matched []pluginMatch
 	for _, plugin := range plugins {
 		Log(Trace, fmt.Sprintf("Checking availability of plugin \"%s\" in channel \"%s\" for user \"%s\", active in %d channels (allchannels: %t)", plugin.name, bot.Channel, bot.User, len(plugin.Channels), plugin.AllChannels))
 		ok := pluginAvailable(bot.User, bot.Channel, plugin)
@@ -117,112 +116,136 @@ func checkPluginMatchersAndRun(checkCommands bool, bot *Robot, messagetext strin
 		for _, matcher := range matchers {
 			Log(Trace, fmt.Sprintf("Checking \"%s\" against \"%s\"", messagetext, matcher.Regex))
 			matches := matcher.re.FindAllStringSubmatch(messagetext, -1)
-			var matched bool
 			if matches != nil {
-				matched = true
 				Log(Trace, fmt.Sprintf("Message \"%s\" matches command \"%s\"", messagetext, matcher.Command))
-				cmdArgs = matches[0][1:]
-				if len(matcher.Contexts) > 0 {
-					// Resolve & store "it" with short-term memories
-					ts := time.Now()
-					shortTermMemories.Lock()
-					for i, contextLabel := range matcher.Contexts {
-						if contextLabel != "" {
-							key := "context:" + contextLabel
-							c := memoryContext{key, bot.User, bot.Channel}
-							if len(cmdArgs) > i && (cmdArgs[i] == "it" || cmdArgs[i] == "") {
-								s, ok := shortTermMemories.m[c]
-								if ok {
-									cmdArgs[i] = s.memory
-									// TODO: it would probably be best to substitute the value
-									// from "it" back in to the original message and re-check for
-									// a match. Failing a match, matched should be set to false.
-									s.timestamp = ts
-									shortTermMemories.m[c] = s
-								} else {
-									bot.Say(fmt.Sprintf("Sorry, I don't remember which %s we were talking about - please re-enter your command and be more specific", contextLabel))
-									shortTermMemories.Unlock()
-									return true
-								}
-							} else {
-								s := shortTermMemory{cmdArgs[i], ts}
-								shortTermMemories.m[c] = s
-							}
-						}
-					}
-					shortTermMemories.Unlock()
-				}
-			}
-			if matched {
-				if commandMatched {
-					Log(Error, fmt.Sprintf("Message \"%s\" matched multiple plugins: %s and %s", messagetext, runPlugin.name, plugin.name))
-					bot.Say("Yikes! Your command matched multiple plugins, so I'm not doing ANYTHING")
-					return
-				}
-				commandMatched = true
-				runPlugin = plugin
-				matchedMatcher = matcher
+				matched = append(matched, pluginMatch{plugin, matcher, matches[0][1:], messagetext, checkCommands})
 				break
 			}
 		} // end of matcher checking
 	} // end of plugin checking
-	if commandMatched {
-		plugin := runPlugin
-		matcher := matchedMatcher
-		abort := false
-		if plugin.name == "builtInadmin" && matcher.Command == "abort" {
-			abort = true
+	if len(matched) == 0 {
+		return
+	}
+	commandMatched = true
+	matched = highestPriority(matched)
+	if len(matched) > 1 {
+		names := make([]string, len(matched))
+		for i, m := range matched {
+			names[i] = m.plugin.name
 		}
-		pluginsRunning.Lock()
-		if pluginsRunning.shuttingDown && !abort {
-			bot.Say("Sorry, I'm shutting down and can't start any new tasks")
-			pluginsRunning.Unlock()
-			return
-		} else if pluginsRunning.paused && !abort {
-			bot.Say("Sorry, I've been paused and can't start any new tasks")
-			pluginsRunning.Unlock()
+		if !checkCommands {
+			Log(Error, fmt.Sprintf("Message \"%s\" matched multiple plugins: %s", messagetext, strings.Join(names, ", ")))
+			bot.Say("Yikes! Your command matched multiple plugins, so I'm not doing ANYTHING")
 			return
 		}
+		Log(Debug, fmt.Sprintf("Command \"%s\" matched multiple plugins, asking user \"%s\" to choose: %s", messagetext, bot.User, strings.Join(names, ", ")))
+		interruptReplyWaiters(bot)
+		go disambiguate(bot, plugins, matched, messagetext)
+		return
+	}
+	runMatch(bot, plugins, matched[0])
+	return
+}
+
+// runMatch resolves contexts for a matched command, checks whether it can
+// run, and calls the plugin.
+func runMatch(bot *Robot, plugins []*Plugin, m pluginMatch) {
+	plugin := m.plugin
+	matcher := m.matcher
+	cmdArgs, ok := resolveContexts(bot, m)
+	if !ok {
+		return
+	}
+	args, err := namedArgs(matcher, cmdArgs)
+	if err != nil {
+		Log(Debug, fmt.Sprintf("Invalid arguments for command \"%s\" in plugin \"%s\" from user \"%s\": %v", matcher.Command, plugin.name, bot.User, err))
+		bot.Reply(fmt.Sprintf("Sorry, I can't run the \"%s\" command - %v", matcher.Command, err))
+		return
+	}
+	abort := false
+	if plugin.name == "builtInadmin" && matcher.Command == "abort" {
+		abort = true
+	}
+	pluginsRunning.Lock()
+	if pluginsRunning.shuttingDown && !abort {
+		bot.Say("Sorry, I'm shutting down and can't start any new tasks")
 		pluginsRunning.Unlock()
-		// Check to see if user issued a new command when a reply was being
-		// waited on
-		replyMatcher := replyMatcher{bot.User, bot.Channel}
-		replies.Lock()
-		waiters, waitingForReply := replies.m[replyMatcher]
-		if waitingForReply {
-			delete(replies.m, replyMatcher)
-			replies.Unlock()
-			for i, rep := range waiters {
-				if i == 0 {
-					rep.replyChannel <- reply{false, replyInterrupted, ""}
-				} else {
-					rep.replyChannel <- reply{false, retryPrompt, ""}
-				}
-			}
-			Log(Debug, fmt.Sprintf("User \"%s\" matched a new command while the robot was waiting for a reply in channel \"%s\"", bot.User, bot.Channel))
-		} else {
-			replies.Unlock()
-		}
-		if bot.checkAuthorization(plugins, plugin, matcher.Command, cmdArgs...) != Success {
+		return
+	} else if pluginsRunning.paused && !abort {
+		bot.Say("Sorry, I've been paused and can't start any new tasks")
+		pluginsRunning.Unlock()
+		return
+	}
+	pluginsRunning.Unlock()
+	if plugin.pluginType != plugBuiltin {
+		if wait, limited := checkRateLimits(bot, plugin, matcher); limited {
+			Log(Info, fmt.Sprintf("Rate limited command \"%s\" for plugin \"%s\", user \"%s\" in channel \"%s\"", matcher.Command, plugin.name, bot.User, bot.Channel))
+			sendRateLimitReply(bot, wait)
 			return
 		}
-		if bot.checkElevation(plugins, plugin, matcher.Command) != Success {
-			return
+	}
+	// Check to see if user issued a new command when a reply was being
+	// waited on
+	interruptReplyWaiters(bot)
+	if bot.checkAuthorization(plugins, plugin, matcher.Command, cmdArgs...) != Success {
+		return
+	}
+	if bot.checkElevation(plugins, plugin, matcher.Command) != Success {
+		return
+	}
+	if bot.checkConfirmation(plugin, matcher, cmdArgs) != Success {
+		return
+	}
+	if m.command && plugin.name != "builtInhistory" {
+		// record what the user typed, since re-running a command sends it
+		// through middleware again
+		command := bot.typed
+		if command == "" {
+			command = m.message
 		}
-		go callPlugin(bot, plugin, true, true, matcher.Command, cmdArgs...)
+		recordHistory(bot.CanonicalUser(), bot.Channel, command)
 	}
-	return
+	bot.args = args
+	if requestApproval(bot, plugin, matcher.Command, cmdArgs) {
+		return
+	}
+	go callPlugin(bot, plugin, true, true, matcher.Command, cmdArgs...)
+}
+
+// interruptReplyWaiters lets any plugin waiting on a reply from the user know
+// that the user has moved on to a new command.
+func interruptReplyWaiters(bot *Robot) {
+	replyMatcher := replyMatcher{bot.User, bot.Channel}
+	replies.Lock()
+	waiters, waitingForReply := replies.m[replyMatcher]
+	if !waitingForReply {
+		replies.Unlock()
+		return
+	}
+	delete(replies.m, replyMatcher)
+	replies.Unlock()
+	for i, rep := range waiters {
+		if i == 0 {
+			rep.replyChannel <- reply{false, replyInterrupted, ""}
+		} else {
+			rep.replyChannel <- reply{false, retryPrompt, ""}
+		}
+	}
+	Log(Debug, fmt.Sprintf("User \"%s\" matched a new command while the robot was waiting for a reply in channel \"%s\"", bot.User, bot.Channel))
 }
 
 // handleMessage checks the message against plugin commands and full-message matches,
 // then dispatches it to all applicable handlers in a separate go routine. If the robot
-// was addressed directly but nothing matched, any registered CatchAll plugins are called.
+// was addressed directly but nothing matched, the robot suggests the closest commands
+// from plugin help; if there aren't any, the CatchAll plugins are called.
 // There Should Be Only One (catchall, in theory (?))
-func handleMessage(isCommand bool, channel, user, messagetext string) {
+func handleMessage(isCommand bool, channel, user, typed, messagetext string, annotations map[string]string) {
 	bot := &Robot{
-		User:    user,
-		Channel: channel,
-		Format:  Variable,
+		User:        user,
+		Channel:     channel,
+		Format:      Variable,
+		annotations: annotations,
+		typed:       typed,
 	}
 	defer checkPanic(bot, messagetext)
 	currentPlugins.RLock()
@@ -302,10 +325,8 @@ func handleMessage(isCommand bool, channel, user, messagetext string) {
 		pluginsRunning.Lock()
 		if !pluginsRunning.shuttingDown {
 			pluginsRunning.Unlock()
-			Log(Debug, fmt.Sprintf("Unmatched command sent to robot, calling catchalls: %s", messagetext))
-			for _, plugin := range catchAllPlugins {
-				go callPlugin(bot, plugin, true, true, "catchall", messagetext)
-			}
+			Log(Debug, fmt.Sprintf("Unmatched command sent to robot, looking for suggestions: %s", messagetext))
+			go unmatchedCommand(bot, plugins, catchAllPlugins, messagetext)
 		} else {
 			// If the robot is shutting down, just ignore catch-all plugins
 			pluginsRunning.Unlock()
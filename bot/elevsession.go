@@ -0,0 +1,247 @@
+package bot
+
+/* elevsession.go - elevation sessions shared by the elevator plugins.
+   After a user authenticates, the elevator starts a session so the user
+   isn't asked again until it expires; sessions are kept in the brain, so
+   they survive restarts, and administrators can list and revoke them. */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// brain key for elevation sessions
+const elevationDatum = "builtInelevation:sessions"
+
+// Values for an elevator's TimeoutType
+const (
+	IdleTimeout     = "idle"     // sessions expire TimeoutSeconds after the last elevated command (default)
+	AbsoluteTimeout = "absolute" // sessions expire TimeoutSeconds after the user authenticated
+)
+
+// elevationSession is an active elevation for a user
+type elevationSession struct {
+	User    string    // the user's handle when the session started, for listing
+	Started time.Time // when the user authenticated
+	Expires time.Time
+}
+
+// elevationStore maps elevator plugin -> canonical user -> session
+type elevationStore map[string]map[string]*elevationSession
+
+// serializes changes to the datum
+var elevations = struct {
+	sync.Mutex
+}{
+	sync.Mutex{},
+}
+
+// updateElevations checks out the sessions, drops any that have expired,
+// calls update, and saves the result if anything changed.
+func updateElevations(update func(store elevationStore) bool) RetVal {
+	elevations.Lock()
+	defer elevations.Unlock()
+	var store elevationStore
+	locktoken, _, ret := checkoutDatum(elevationDatum, &store, true)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error checking out elevation sessions from the brain: %s", ret))
+		return ret
+	}
+	if store == nil {
+		store = make(elevationStore)
+	}
+	now := time.Now()
+	changed := false
+	for elevator, sessions := range store {
+		for user, s := range sessions {
+			if now.After(s.Expires) {
+				delete(sessions, user)
+				changed = true
+			}
+		}
+		if len(sessions) == 0 {
+			delete(store, elevator)
+			changed = true
+		}
+	}
+	if update(store) {
+		changed = true
+	}
+	if !changed {
+		checkinDatum(elevationDatum, locktoken)
+		return Ok
+	}
+	if ret := updateDatum(elevationDatum, locktoken, store); ret != Ok {
+		Log(Error, fmt.Sprintf("Error saving elevation sessions to the brain: %s", ret))
+		return ret
+	}
+	return Ok
+}
+
+// elevatorName is the name of the calling elevator plugin, false if the
+// robot's plugin isn't loaded
+func (r *Robot) elevatorName() (string, bool) {
+	plugin := currentPlugins.getPluginByID(r.pluginID)
+	if plugin == nil {
+		Log(Error, fmt.Sprintf("Elevation session requested by unknown plugin ID \"%s\"", r.pluginID))
+		return "", false
+	}
+	return plugin.name, true
+}
+
+// CheckElevationSession returns true if the user has an unexpired elevation
+// session with the calling elevator plugin. With idle timeouts (any
+// timeoutType other than "absolute"), an active session is extended for
+// another timeoutSeconds.
+func (r *Robot) CheckElevationSession(timeoutSeconds int, timeoutType string) bool {
+	elevator, ok := r.elevatorName()
+	if !ok {
+		return false
+	}
+	user := r.CanonicalUser()
+	active := false
+	ret := updateElevations(func(store elevationStore) bool {
+		s, ok := store[elevator][user]
+		if !ok {
+			return false
+		}
+		active = true
+		if timeoutType == AbsoluteTimeout {
+			return false
+		}
+		s.Expires = time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+		return true
+	})
+	return ret == Ok && active
+}
+
+// StartElevationSession starts (or restarts) the user's elevation session
+// with the calling elevator plugin after they've successfully authenticated.
+// No session is started when timeoutSeconds is 0. It returns true if the
+// session was started.
+func (r *Robot) StartElevationSession(timeoutSeconds int) bool {
+	if timeoutSeconds <= 0 {
+		return false
+	}
+	elevator, ok := r.elevatorName()
+	if !ok {
+		return false
+	}
+	user := r.CanonicalUser()
+	now := time.Now()
+	ret := updateElevations(func(store elevationStore) bool {
+		if store[elevator] == nil {
+			store[elevator] = make(map[string]*elevationSession)
+		}
+		store[elevator][user] = &elevationSession{
+			User:    r.User,
+			Started: now,
+			Expires: now.Add(time.Duration(timeoutSeconds) * time.Second),
+		}
+		return true
+	})
+	if ret != Ok {
+		return false
+	}
+	Log(Debug, fmt.Sprintf("Started elevation session for user \"%s\" with elevator \"%s\"", user, elevator))
+	return true
+}
+
+// RevokeElevationSession ends a user's session with the calling elevator
+// plugin, e.g. when their credentials are reset; user is the canonical
+// identity. It returns true if there was a session.
+func (r *Robot) RevokeElevationSession(user string) bool {
+	elevator, ok := r.elevatorName()
+	if !ok {
+		return false
+	}
+	revoked := false
+	updateElevations(func(store elevationStore) bool {
+		if _, ok := store[elevator][user]; ok {
+			delete(store[elevator], user)
+			revoked = true
+		}
+		return revoked
+	})
+	if revoked {
+		Log(Audit, fmt.Sprintf("Elevation session for user \"%s\" with elevator \"%s\" revoked", user, elevator))
+	}
+	return revoked
+}
+
+// revokeElevations ends all of a user's sessions, or everybody's when user
+// is empty, returning how many were revoked. The user can be given by their
+// canonical identity or a handle; sessions are matched on the canonical
+// identity of the handle, as well as the handle the session started with.
+func revokeElevations(user string) (count int, ret RetVal) {
+	canonical := ""
+	if user != "" {
+		canonical = canonicalUser(user)
+	}
+	ret = updateElevations(func(store elevationStore) bool {
+		for _, sessions := range store {
+			for u, s := range sessions {
+				if user == "" || u == user || u == canonical || s.User == user {
+					delete(sessions, u)
+					count++
+				}
+			}
+		}
+		return count > 0
+	})
+	return count, ret
+}
+
+func elevation(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	switch command {
+	case "init":
+		return
+	case "list":
+		var lines []string
+		now := time.Now()
+		ret := updateElevations(func(store elevationStore) bool {
+			for elevator, sessions := range store {
+				for user, s := range sessions {
+					lines = append(lines, fmt.Sprintf("%s (%s) via %s: authenticated %s ago, expires in %s", user, s.User, elevator,
+						now.Sub(s.Started)/time.Second*time.Second, s.Expires.Sub(now)/time.Second*time.Second))
+				}
+			}
+			return false
+		})
+		if ret != Ok {
+			bot.Reply("Sorry, I wasn't able to check the elevation sessions")
+			return
+		}
+		if len(lines) == 0 {
+			bot.Say("There are no active elevation sessions")
+			return
+		}
+		sort.Strings(lines)
+		bot.Fixed().Say("Active elevation sessions:\n" + strings.Join(lines, "\n"))
+	case "revoke", "revokeall":
+		user := ""
+		if command == "revoke" {
+			user = args[0]
+		}
+		count, ret := revokeElevations(user)
+		if ret != Ok {
+			bot.Reply("Sorry, I wasn't able to update the elevation sessions")
+			return
+		}
+		if user == "" {
+			Log(Audit, fmt.Sprintf("User \"%s\" revoked all %d elevation sessions", bot.User, count))
+			bot.Reply(fmt.Sprintf("Ok, I revoked %d elevation sessions", count))
+			return
+		}
+		if count == 0 {
+			bot.Reply(fmt.Sprintf("User \"%s\" doesn't have any elevation sessions", user))
+			return
+		}
+		Log(Audit, fmt.Sprintf("User \"%s\" revoked %d elevation sessions for user \"%s\"", bot.User, count, user))
+		bot.Reply(fmt.Sprintf("Ok, I revoked %d elevation sessions for \"%s\"", count, user))
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"testing"
+)
+
+const rosterConf = `
+Name: floyd
+Protocol: test
+DefaultChannels: [ "general" ]
+AdminUsers: [ "root" ]
+UserRoster:
+  alicek:
+    ProtocolIDs:
+      test: U1
+`
+
+// elevator returns a Robot for user, calling as the builtin elevation
+// plugin; sessions only need a loaded plugin to key on
+func elevator(user string) *Robot {
+	return &Robot{
+		User:     user,
+		Channel:  "general",
+		pluginID: currentPlugins.getPluginByName("builtInelevation").pluginID,
+	}
+}
+
+// Sessions are kept under the canonical identity; administrators can revoke
+// them by the user's handle or canonical name.
+func TestRevokeElevationByHandle(t *testing.T) {
+	tc := startTestRobot(t, rosterConf, nil, map[string]string{"alice": "U1", "root": "U0"})
+	for _, name := range []string{"alice", "alicek"} {
+		r := elevator("alice")
+		if !r.StartElevationSession(60) {
+			t.Fatal("StartElevationSession failed")
+		}
+		send("general", "root", "floyd, revoke elevation for "+name)
+		tc.expect(t, "I revoked 1 elevation sessions")
+		if r.CheckElevationSession(60, IdleTimeout) {
+			t.Errorf("Session for alice still active after revoking for %s", name)
+		}
+	}
+	// after alice changes their handle, the session is found by the new one
+	elevator("alice").StartElevationSession(60)
+	tc.setID("alice2", "U1")
+	send("general", "root", "floyd, revoke elevation for alice2")
+	tc.expect(t, "I revoked 1 elevation sessions")
+	// the exported function takes the canonical identity
+	r := elevator("alice")
+	r.StartElevationSession(60)
+	if !r.RevokeElevationSession("alicek") {
+		t.Error("RevokeElevationSession didn't find alicek's session")
+	}
+}
+
+func TestElevationSessionUnknownPlugin(t *testing.T) {
+	startTestRobot(t, rosterConf, nil, nil)
+	r := &Robot{User: "alice", Channel: "general", pluginID: "nonexistent"}
+	if r.StartElevationSession(60) {
+		t.Error("StartElevationSession succeeded for an unknown plugin")
+	}
+	if r.CheckElevationSession(60, IdleTimeout) {
+		t.Error("CheckElevationSession succeeded for an unknown plugin")
+	}
+	if r.RevokeElevationSession("alice") {
+		t.Error("RevokeElevationSession succeeded for an unknown plugin")
+	}
+}
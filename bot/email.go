@@ -19,10 +19,24 @@ type botMailer struct {
 // Email provides a simple interface for sending the user an email from the
 // robot.. It relies on both the robot and the user having an email address.
 // For the robot, this can be conifigured in gopherbot.conf, Email attribute.
-// For the user, this should be provided by the chat protocol, or in
-// gopherbot.conf. (TODO: not yet implemented)
+// For the user, this should be provided by the chat protocol, or in the
+// UserRoster in gopherbot.yaml.
 // It returns an error and RetVal != 0 if there's a problem.
 func (r *Robot) Email(subject string, messageBody *bytes.Buffer) (ret RetVal) {
+	return r.EmailWithAttachments(subject, messageBody)
+}
+
+// EmailAttachment is a file attached to an email sent with
+// EmailWithAttachments
+type EmailAttachment struct {
+	Filename    string // name of the attached file, e.g. "launchcodes.png"
+	ContentType string // MIME type, e.g. "image/png"; defaults to application/octet-stream
+	Content     []byte
+}
+
+// EmailWithAttachments is like Email, but attaches files to the message,
+// e.g. an image.
+func (r *Robot) EmailWithAttachments(subject string, messageBody *bytes.Buffer, attachments ...EmailAttachment) (ret RetVal) {
 	var mailFrom, botName, mailTo string
 
 	mailAttr := r.GetBotAttribute("email")
@@ -50,6 +64,12 @@ func (r *Robot) Email(subject string, messageBody *bytes.Buffer) (ret RetVal) {
 	e.To = []string{mailTo}
 	e.Subject = subject
 	e.Text = messageBody.Bytes()
+	for _, att := range attachments {
+		if _, err := e.Attach(bytes.NewReader(att.Content), att.Filename, att.ContentType); err != nil {
+			r.Log(Error, fmt.Sprintf("Attaching \"%s\" to email: %v", att.Filename, err))
+			return MailError
+		}
+	}
 
 	var a smtp.Auth
 	if robot.mailConf.Authtype == "plain" {
@@ -21,6 +21,11 @@ const (
 	ConfigurationError
 	// UntrustedPlugin indicates a plugin was called by an untrusted plugin
 	UntrustedPlugin
+	// TimedOut indicates an external plugin ran past it's configured Timeout and was killed
+	TimedOut
+	// Canceled indicates the plugin's job was canceled by an administrator, or
+	// while queued when the robot started shutting down
+	Canceled
 )
 
 const (
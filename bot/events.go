@@ -0,0 +1,102 @@
+package bot
+
+/* events.go - events from the connector other than messages, e.g. users
+   joining the team or channels being created, are passed on to plugins that
+   subscribe to them with EventSubscriptions. */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Standard event types; connectors should use these where they apply, and
+// may report other protocol-specific types.
+const (
+	EventUserJoined        = "user_joined"        // A new user joined the team
+	EventUserChanged       = "user_changed"       // A user's profile changed
+	EventPresenceChanged   = "presence_changed"   // A user's presence changed; Data["presence"] has the new presence
+	EventChannelCreated    = "channel_created"    // A channel was created; User is the creator
+	EventChannelDeleted    = "channel_deleted"    // A channel was deleted
+	EventChannelArchived   = "channel_archived"   // A channel was archived
+	EventChannelUnarchived = "channel_unarchived" // A channel was unarchived
+	EventChannelRenamed    = "channel_renamed"    // A channel was renamed; Data["oldname"] has the old name
+	EventRobotJoined       = "robot_joined"       // The robot was added to a channel
+	EventRobotLeft         = "robot_left"         // The robot was removed from a channel
+)
+
+// Event is a protocol event other than a message, reported by the connector
+// with Handler.IncomingEvent.
+type Event struct {
+	Type    string            // The type of event, e.g. EventUserJoined
+	User    string            // The user the event is about or caused it, if any
+	Channel string            // The channel the event is about, if any
+	Data    map[string]string // Additional event-specific information
+}
+
+// IncomingEvent accepts an event from the connector, and calls all the
+// plugins subscribed to the event's type.
+func (h handler) IncomingEvent(ev Event) {
+	robot.RLock()
+	for _, user := range robot.ignoreUsers {
+		if ev.User != "" && strings.EqualFold(ev.User, user) {
+			robot.RUnlock()
+			Log(Trace, fmt.Sprintf("Ignoring event \"%s\" for ignored user \"%s\"", ev.Type, ev.User))
+			return
+		}
+	}
+	robot.RUnlock()
+	dispatchEvent(ev)
+}
+
+// dispatchEvent calls subscribed plugins with a command of "event:<type>",
+// and arguments of the user, the channel, then the sorted Data as
+// "key=value" strings. The Data is also available from Robot.Args().
+func dispatchEvent(ev Event) {
+	pluginsRunning.Lock()
+	if pluginsRunning.shuttingDown || pluginsRunning.paused {
+		pluginsRunning.Unlock()
+		Log(Debug, fmt.Sprintf("Not dispatching event \"%s\" while shutting down or paused", ev.Type))
+		return
+	}
+	pluginsRunning.Unlock()
+	currentPlugins.RLock()
+	plugins := currentPlugins.p
+	currentPlugins.RUnlock()
+	keys := make([]string, 0, len(ev.Data))
+	for key := range ev.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys)+2)
+	args = append(args, ev.User, ev.Channel)
+	for _, key := range keys {
+		args = append(args, key+"="+ev.Data[key])
+	}
+	command := "event:" + ev.Type
+	Log(Debug, fmt.Sprintf("Received event \"%s\" for user \"%s\" in channel \"%s\": %v", ev.Type, ev.User, ev.Channel, ev.Data))
+	for _, plugin := range plugins {
+		if !plugin.subscribesTo(ev.Type) {
+			continue
+		}
+		bot := &Robot{
+			User:    ev.User,
+			Channel: ev.Channel,
+			Format:  Variable,
+			args:    ev.Data,
+		}
+		Log(Debug, fmt.Sprintf("Sending event \"%s\" to plugin \"%s\"", ev.Type, plugin.name))
+		go callPlugin(bot, plugin, true, false, command, args...)
+	}
+}
+
+// subscribesTo checks whether a plugin subscribes to an event type; "*"
+// subscribes to all events.
+func (plugin *Plugin) subscribesTo(eventType string) bool {
+	for _, sub := range plugin.EventSubscriptions {
+		if sub == eventType || sub == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package bot
+
+import "testing"
+
+// Exported for tests in package bot_test, which can import the bundled Go
+// plugins.
+
+type TestConnector = testConnector
+
+func StartTestRobot(t *testing.T, conf string, pluginConf map[string]string, ids map[string]string) *TestConnector {
+	t.Helper()
+	return startTestRobot(t, conf, pluginConf, ids)
+}
+
+func (tc *TestConnector) Expect(t *testing.T, want string) string {
+	t.Helper()
+	return tc.expect(t, want)
+}
+
+func Send(channel, user, msg string) {
+	send(channel, user, msg)
+}
@@ -0,0 +1,251 @@
+package bot
+
+/* groups.go - the builtin group authorizer. Groups are defined in
+   gopherbot.yaml, and users with the groups.manage permission can add and
+   remove members at runtime; changes are kept in the brain. A member
+   that's the name of another group includes all of that group's members. */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// brain key for runtime changes to group membership
+const groupsDatum = "builtIngroups:members"
+
+// groupChanges records members added to and removed from a configured group
+type groupChanges struct {
+	Added   []string
+	Removed []string
+}
+
+// serializes changes to the datum
+var groupUpdates = struct {
+	sync.Mutex
+}{
+	sync.Mutex{},
+}
+
+// configuredGroups returns the Groups from gopherbot.yaml
+func configuredGroups() map[string][]string {
+	robot.RLock()
+	groups := robot.groups
+	robot.RUnlock()
+	return groups
+}
+
+// loadGroupChanges reads the runtime membership changes from the brain
+func loadGroupChanges() (map[string]groupChanges, RetVal) {
+	var changes map[string]groupChanges
+	_, _, ret := checkoutDatum(groupsDatum, &changes, false)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error loading group membership from the brain: %s", ret))
+		return nil, ret
+	}
+	if changes == nil {
+		changes = make(map[string]groupChanges)
+	}
+	return changes, Ok
+}
+
+// contains checks whether a list of names contains name
+func contains(list []string, name string) bool {
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns list with any occurrences of name removed
+func without(list []string, name string) []string {
+	kept := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != name {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// groupMembers gives the direct members of a group (users and nested
+// groups), with runtime changes applied
+func groupMembers(groups map[string][]string, changes map[string]groupChanges, group string) []string {
+	members := make([]string, 0, len(groups[group]))
+	for _, member := range groups[group] {
+		if !contains(changes[group].Removed, member) {
+			members = append(members, member)
+		}
+	}
+	for _, member := range changes[group].Added {
+		if !contains(members, member) {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// inGroup checks whether the user is a member of the group, directly or
+// through nested groups; seen guards against groups that include each other.
+func inGroup(groups map[string][]string, changes map[string]groupChanges, user, group string, seen map[string]bool) bool {
+	if seen[group] {
+		return false
+	}
+	seen[group] = true
+	for _, member := range groupMembers(groups, changes, group) {
+		if _, isGroup := groups[member]; isGroup {
+			if inGroup(groups, changes, user, member, seen) {
+				return true
+			}
+		} else if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+// changeMembership adds or removes a member of a configured group, saving
+// the change in the brain.
+func changeMembership(group, member string, add bool) (changed bool, ret RetVal) {
+	groups := configuredGroups()
+	groupUpdates.Lock()
+	defer groupUpdates.Unlock()
+	var changes map[string]groupChanges
+	locktoken, _, ret := checkoutDatum(groupsDatum, &changes, true)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error checking out group membership from the brain: %s", ret))
+		return false, ret
+	}
+	if changes == nil {
+		changes = make(map[string]groupChanges)
+	}
+	current := groupMembers(groups, changes, group)
+	gc := changes[group]
+	if add {
+		if contains(current, member) {
+			checkinDatum(groupsDatum, locktoken)
+			return false, Ok
+		}
+		gc.Removed = without(gc.Removed, member)
+		if !contains(groups[group], member) {
+			gc.Added = append(gc.Added, member)
+		}
+	} else {
+		if !contains(current, member) {
+			checkinDatum(groupsDatum, locktoken)
+			return false, Ok
+		}
+		gc.Added = without(gc.Added, member)
+		if contains(groups[group], member) {
+			gc.Removed = append(gc.Removed, member)
+		}
+	}
+	if len(gc.Added) == 0 && len(gc.Removed) == 0 {
+		delete(changes, group)
+	} else {
+		changes[group] = gc
+	}
+	if ret := updateDatum(groupsDatum, locktoken, changes); ret != Ok {
+		Log(Error, fmt.Sprintf("Error saving group membership to the brain: %s", ret))
+		return false, ret
+	}
+	return true, Ok
+}
+
+// groupsAuthorize is called with the standard authorizer arguments:
+// plugin name, AuthRequire (the group), and the command.
+func groupsAuthorize(bot *Robot, args []string) (retval PlugRetVal) {
+	if len(args) < 3 {
+		Log(Error, fmt.Sprintf("Group authorizer called with too few arguments: %q", args))
+		return MechanismFail
+	}
+	plugin, group, command := args[0], args[1], args[2]
+	groups := configuredGroups()
+	if group == "" {
+		Log(Error, fmt.Sprintf("Group authorizer called for command \"%s\" in plugin \"%s\" with no AuthRequire group", command, plugin))
+		return ConfigurationError
+	}
+	if _, ok := groups[group]; !ok {
+		Log(Error, fmt.Sprintf("Group authorizer called for command \"%s\" in plugin \"%s\" with unknown group \"%s\"", command, plugin, group))
+		return ConfigurationError
+	}
+	changes, ret := loadGroupChanges()
+	if ret != Ok {
+		return MechanismFail
+	}
+	if inGroup(groups, changes, bot.CanonicalUser(), group, make(map[string]bool)) {
+		Log(Debug, fmt.Sprintf("User \"%s\" authorized for command \"%s\" in plugin \"%s\" by membership in group \"%s\"", bot.User, command, plugin, group))
+		return Success
+	}
+	return Fail
+}
+
+func groups(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	switch command {
+	case "init":
+		return
+	case "authorize":
+		return groupsAuthorize(bot, args)
+	case "list":
+		configured := configuredGroups()
+		if len(configured) == 0 {
+			bot.Say("There are no groups configured")
+			return
+		}
+		names := make([]string, 0, len(configured))
+		for name := range configured {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		bot.Say(fmt.Sprintf("Groups: %s", strings.Join(names, ", ")))
+	case "show":
+		group := args[0]
+		configured := configuredGroups()
+		if _, ok := configured[group]; !ok {
+			bot.Reply(fmt.Sprintf("I don't have a group named \"%s\"", group))
+			return
+		}
+		changes, ret := loadGroupChanges()
+		if ret != Ok {
+			bot.Reply("Sorry, I wasn't able to load group membership from the brain")
+			return
+		}
+		members := groupMembers(configured, changes, group)
+		if len(members) == 0 {
+			bot.Say(fmt.Sprintf("Group \"%s\" has no members", group))
+			return
+		}
+		sort.Strings(members)
+		bot.Say(fmt.Sprintf("Members of group \"%s\": %s", group, strings.Join(members, ", ")))
+	case "add", "remove":
+		if !bot.checkPermission(PermGroupsManage) {
+			return
+		}
+		member, group := args[0], args[1]
+		if _, ok := configuredGroups()[group]; !ok {
+			bot.Reply(fmt.Sprintf("I don't have a group named \"%s\"", group))
+			return
+		}
+		changed, ret := changeMembership(group, member, command == "add")
+		if ret != Ok {
+			bot.Reply("Sorry, I wasn't able to save the change to the brain")
+			return
+		}
+		switch {
+		case !changed && command == "add":
+			bot.Reply(fmt.Sprintf("\"%s\" is already a member of group \"%s\"", member, group))
+		case !changed:
+			bot.Reply(fmt.Sprintf("\"%s\" isn't a member of group \"%s\"", member, group))
+		case command == "add":
+			Log(Audit, fmt.Sprintf("User \"%s\" added \"%s\" to group \"%s\"", bot.User, member, group))
+			bot.Reply(fmt.Sprintf("Ok, I added \"%s\" to group \"%s\"", member, group))
+		default:
+			Log(Audit, fmt.Sprintf("User \"%s\" removed \"%s\" from group \"%s\"", bot.User, member, group))
+			bot.Reply(fmt.Sprintf("Ok, I removed \"%s\" from group \"%s\"", member, group))
+		}
+	}
+	return
+}
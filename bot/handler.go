@@ -71,7 +71,17 @@ func (h handler) IncomingMessage(channelName, userName, messageFull string) {
 		logChannel = "(direct message)"
 	}
 	Log(Trace, fmt.Sprintf("Command \"%s\" in channel \"%s\"", message, logChannel))
-	handleMessage(isCommand, channelName, userName, message)
+	msg := &Message{
+		User:        userName,
+		Channel:     channelName,
+		Text:        message,
+		IsCommand:   isCommand,
+		Annotations: make(map[string]string),
+	}
+	if !runMiddleware(msg) {
+		return
+	}
+	handleMessage(msg.IsCommand, channelName, userName, message, msg.Text, msg.Annotations)
 }
 
 // GetProtocolConfig unmarshals the connector's configuration data into a provided struct
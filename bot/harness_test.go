@@ -0,0 +1,164 @@
+package bot
+
+/* harness_test.go - a robot running on an in-memory connector and brain,
+   configured from files in a temporary directory, for tests that drive
+   messages through the whole dispatch path. */
+
+import (
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// how long to wait for the robot to say something
+const messageTimeout = 5 * time.Second
+
+// testConnector records everything the robot sends. Users' internal IDs
+// come from ids; users without one have no internalID attribute.
+type testConnector struct {
+	sync.Mutex
+	ids      map[string]string
+	messages chan string
+}
+
+func (tc *testConnector) GetProtocolUserAttribute(user, attr string) (string, RetVal) {
+	switch attr {
+	case "internalID":
+		tc.Lock()
+		defer tc.Unlock()
+		if id, ok := tc.ids[user]; ok {
+			return id, Ok
+		}
+	case "email":
+		return user + "@example.com", Ok
+	}
+	return "", AttributeNotFound
+}
+
+func (tc *testConnector) JoinChannel(channel string) RetVal {
+	return Ok
+}
+
+func (tc *testConnector) SendProtocolChannelMessage(channel, msg string, f MessageFormat) RetVal {
+	tc.messages <- channel + ": " + msg
+	return Ok
+}
+
+func (tc *testConnector) SendProtocolUserChannelMessage(user, channel, msg string, f MessageFormat) RetVal {
+	tc.messages <- channel + ": " + user + ": " + msg
+	return Ok
+}
+
+func (tc *testConnector) SendProtocolUserMessage(user, msg string, f MessageFormat) RetVal {
+	tc.messages <- "(direct) " + user + ": " + msg
+	return Ok
+}
+
+func (tc *testConnector) Run(stop chan struct{}) {}
+
+// setID changes the internal ID the connector reports for a user, e.g.
+// to simulate a user changing their handle
+func (tc *testConnector) setID(user, id string) {
+	tc.Lock()
+	tc.ids[user] = id
+	tc.Unlock()
+}
+
+// expect waits for the robot to send a message containing want, skipping
+// anything else it says first, and returns the message
+func (tc *testConnector) expect(t *testing.T, want string) string {
+	t.Helper()
+	timeout := time.After(messageTimeout)
+	for {
+		select {
+		case msg := <-tc.messages:
+			if strings.Contains(msg, want) {
+				return msg
+			}
+			t.Logf("Skipping message: %s", msg)
+		case <-timeout:
+			t.Fatalf("Robot didn't send a message containing %q", want)
+			return ""
+		}
+	}
+}
+
+// memBrain is a SimpleBrain kept in memory
+type memBrain struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+func (b *memBrain) Store(key string, datum []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	b.m[key] = datum
+	return nil
+}
+
+func (b *memBrain) Retrieve(key string) ([]byte, bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	datum, ok := b.m[key]
+	return datum, ok, nil
+}
+
+var startBrain sync.Once
+
+// startTestRobot configures the robot from gopherbot.yaml and plugin
+// configuration in a new temporary directory, connected to a fresh
+// testConnector and brain. Users in ids are reported with those internal
+// IDs. The robot isn't initialized, so plugin init hooks don't run.
+func startTestRobot(t *testing.T, conf string, pluginConf map[string]string, ids map[string]string) *testConnector {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf", "plugins"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "conf", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("gopherbot.yaml", conf)
+	for name, content := range pluginConf {
+		write(filepath.Join("plugins", name+".yaml"), content)
+	}
+	if ids == nil {
+		ids = make(map[string]string)
+	}
+	tc := &testConnector{ids: ids, messages: make(chan string, 100)}
+	logger := log.New(ioutil.Discard, "", 0)
+	if testing.Verbose() {
+		logger = log.New(os.Stderr, "", log.Ltime)
+	}
+	globalLock.Lock()
+	stopRegistrations = true
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	globalLock.Unlock()
+	robot.Lock()
+	robot.localPath = dir
+	robot.installPath = filepath.Join(dir, "install")
+	robot.logger = logger
+	robot.Connector = tc
+	robot.brain = &memBrain{m: make(map[string][]byte)}
+	robot.Unlock()
+	startBrain.Do(func() { go runBrain() })
+	if err := loadConfig(); err != nil {
+		t.Fatalf("Loading configuration: %v", err)
+	}
+	return tc
+}
+
+// send delivers a message to the robot as if it came from the connector
+func send(channel, user, msg string) {
+	handler{}.IncomingMessage(channel, user, msg)
+}
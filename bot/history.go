@@ -0,0 +1,193 @@
+package bot
+
+/* history.go - a bounded per-user, per-channel history of matched commands,
+   kept in memory or optionally in the brain, and the builtin for listing
+   and re-running them. */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// how many commands to remember per user and channel, by default
+const defaultHistorySize = 10
+
+// brain key for the history, when HistoryInBrain is set
+const historyDatum = "builtInhistory:history"
+
+type historyKey struct {
+	user, channel string
+}
+
+// String gives the key used in the brain datum
+func (k historyKey) String() string {
+	return k.user + "/" + k.channel
+}
+
+var commandHistory = struct {
+	m      map[historyKey][]string
+	loaded bool // whether the history has been loaded from the brain
+	sync.Mutex
+}{
+	make(map[historyKey][]string),
+	false,
+	sync.Mutex{},
+}
+
+// historySettings returns the configured history size and whether the history
+// is kept in the brain
+func historySettings() (size int, inBrain bool) {
+	robot.RLock()
+	size, inBrain = robot.historySize, robot.historyInBrain
+	robot.RUnlock()
+	if size == 0 {
+		size = defaultHistorySize
+	}
+	return
+}
+
+// loadHistory loads the history from the brain the first time it's needed;
+// called with commandHistory locked.
+func loadHistory() {
+	if commandHistory.loaded {
+		return
+	}
+	commandHistory.loaded = true
+	var stored map[string][]string
+	_, exists, ret := checkoutDatum(historyDatum, &stored, false)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error loading command history from the brain: %s", ret))
+		return
+	}
+	if !exists {
+		return
+	}
+	for key, commands := range stored {
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		commandHistory.m[historyKey{parts[0], parts[1]}] = commands
+	}
+}
+
+// saveHistory writes the history to the brain; called with commandHistory
+// locked.
+func saveHistory() {
+	stored := make(map[string][]string)
+	for key, commands := range commandHistory.m {
+		stored[key.String()] = commands
+	}
+	var old map[string][]string
+	locktoken, _, ret := checkoutDatum(historyDatum, &old, true)
+	if ret != Ok {
+		Log(Error, fmt.Sprintf("Error checking out command history from the brain: %s", ret))
+		return
+	}
+	if ret := updateDatum(historyDatum, locktoken, stored); ret != Ok {
+		Log(Error, fmt.Sprintf("Error saving command history to the brain: %s", ret))
+	}
+}
+
+// recordHistory adds a matched command to the user's history for the
+// channel, dropping the oldest commands when the history is full.
+func recordHistory(user, channel, command string) {
+	size, inBrain := historySettings()
+	if size < 0 {
+		return
+	}
+	key := historyKey{user, channel}
+	commandHistory.Lock()
+	defer commandHistory.Unlock()
+	if inBrain {
+		loadHistory()
+	}
+	commands := append(commandHistory.m[key], command)
+	if len(commands) > size {
+		commands = commands[len(commands)-size:]
+	}
+	commandHistory.m[key] = commands
+	if inBrain {
+		saveHistory()
+	}
+}
+
+// getHistory returns a copy of the user's history for the channel, oldest
+// first.
+func getHistory(user, channel string) []string {
+	_, inBrain := historySettings()
+	commandHistory.Lock()
+	defer commandHistory.Unlock()
+	if inBrain {
+		loadHistory()
+	}
+	commands := commandHistory.m[historyKey{user, channel}]
+	history := make([]string, len(commands))
+	copy(history, commands)
+	return history
+}
+
+// rerunCommand sends a command from the history back through middleware
+// and checkPluginMatchersAndRun, so it gets the same middleware,
+// authorization and elevation checks as if the user had typed it again. The
+// history has commands as the user typed them, before middleware.
+func rerunCommand(bot *Robot, command string) {
+	msg := &Message{
+		User:        bot.User,
+		Channel:     bot.Channel,
+		Text:        command,
+		IsCommand:   true,
+		Annotations: make(map[string]string),
+	}
+	if !runMiddleware(msg) {
+		return
+	}
+	bot.Say(fmt.Sprintf("Running: %s", msg.Text))
+	rbot := &Robot{
+		User:        bot.User,
+		Channel:     bot.Channel,
+		Format:      Variable,
+		annotations: msg.Annotations,
+		typed:       command,
+	}
+	if !checkPluginMatchersAndRun(true, rbot, msg.Text) {
+		bot.Reply("Sorry, that doesn't match any of my commands any more")
+	}
+}
+
+func history(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+	switch command {
+	case "init":
+		return
+	case "history":
+		commands := getHistory(bot.CanonicalUser(), bot.Channel)
+		if len(commands) == 0 {
+			bot.Reply("I don't have any command history for you here")
+			return
+		}
+		lines := make([]string, 0, len(commands)+1)
+		lines = append(lines, "Your recent commands:")
+		for i, c := range commands {
+			lines = append(lines, fmt.Sprintf("%d: %s", i+1, c))
+		}
+		bot.Fixed().Reply(strings.Join(lines, "\n"))
+	case "again", "againwith":
+		commands := getHistory(bot.CanonicalUser(), bot.Channel)
+		if len(commands) == 0 {
+			bot.Reply("I don't have any command history for you here")
+			return
+		}
+		last := commands[len(commands)-1]
+		if command == "againwith" {
+			from, to := args[0], args[1]
+			if !strings.Contains(last, from) {
+				bot.Reply(fmt.Sprintf("Your last command (\"%s\") doesn't contain \"%s\"", last, from))
+				return
+			}
+			last = strings.Replace(last, from, to, 1)
+		}
+		rerunCommand(bot, last)
+	}
+	return
+}
@@ -0,0 +1,32 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+// Commands are recorded as typed, so middleware that isn't idempotent
+// doesn't rewrite them twice when they're re-run.
+func TestRerunWithRewritingMiddleware(t *testing.T) {
+	middlewares.Lock()
+	middlewares.m["expand"] = func(bot *Robot, msg *Message) bool {
+		msg.Text = strings.Replace(msg.Text, "inf", "info", 1)
+		return true
+	}
+	middlewares.Unlock()
+	defer func() {
+		middlewares.Lock()
+		delete(middlewares.m, "expand")
+		middlewares.Unlock()
+	}()
+	tc := startTestRobot(t, rosterConf+"Middleware: [ \"expand\" ]\n", nil, nil)
+	send("general", "alice", "floyd, inf")
+	tc.expect(t, "information about my running environment")
+	send("general", "alice", "floyd, history")
+	if msg := tc.expect(t, "Your recent commands"); !strings.HasSuffix(msg, "\n1: inf") {
+		t.Errorf("History doesn't have the command as typed: %s", msg)
+	}
+	send("general", "alice", "floyd, !!")
+	tc.expect(t, "Running: info")
+	tc.expect(t, "information about my running environment")
+}
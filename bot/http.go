@@ -28,6 +28,10 @@ type elevate struct {
 	Immediate bool
 }
 
+type permission struct {
+	Permission string
+}
+
 type userattr struct {
 	User      string
 	Attribute string
@@ -233,6 +237,14 @@ func (h handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		bret := bot.CheckAdmin()
 		sendReturn(rw, boolresponse{Boolean: bret})
 		return
+	case "HasPermission":
+		var p permission
+		if !getArgs(rw, &f.FuncArgs, &p) {
+			return
+		}
+		bret := bot.HasPermission(p.Permission)
+		sendReturn(rw, boolresponse{Boolean: bret})
+		return
 	case "Elevate":
 		var e elevate
 		if !getArgs(rw, &f.FuncArgs, &e) {
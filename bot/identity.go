@@ -0,0 +1,81 @@
+package bot
+
+/* identity.go - mapping the protocol's internal user IDs to stable,
+   canonical user names from the UserRoster, so that AdminUsers, plugin
+   Users, Groups, Roles and per-user brain data survive a user changing
+   their chat handle. */
+
+import (
+	"fmt"
+)
+
+// userIDMap builds the internal ID -> canonical name index for a protocol
+// from the ProtocolIDs in the UserRoster.
+func userIDMap(roster map[string]UserInfo, protocol string) (map[string]string, error) {
+	ids := make(map[string]string)
+	for name, info := range roster {
+		id, ok := info.ProtocolIDs[protocol]
+		if !ok || id == "" {
+			continue
+		}
+		if other, dup := ids[id]; dup {
+			return nil, fmt.Errorf("%s ID \"%s\" is mapped to both \"%s\" and \"%s\"", protocol, id, other, name)
+		}
+		ids[id] = name
+	}
+	return ids, nil
+}
+
+// canonicalUser returns the canonical identity for a user handle reported
+// by the connector. Users with a mapped internal ID get their UserRoster
+// name; other users keep their handle, unless the handle is the canonical
+// name of a mapped user, in which case the (unrelated) user gets the
+// protocol-qualified identity "<protocol>:<internalID>" so they can't
+// inherit that user's access.
+func canonicalUser(user string) string {
+	robot.RLock()
+	ids := robot.userIDs
+	protocol := robot.protocol
+	info, inRoster := robot.userRoster[user]
+	robot.RUnlock()
+	if len(ids) == 0 {
+		return user
+	}
+	id, ret := robot.GetProtocolUserAttribute(user, "internalID")
+	if ret == Ok && id != "" {
+		if name, ok := ids[id]; ok {
+			return name
+		}
+	}
+	if inRoster && info.ProtocolIDs[protocol] != "" {
+		if ret != Ok || id == "" {
+			id = user
+		}
+		Log(Warn, fmt.Sprintf("User handle \"%s\" matches a UserRoster name, but has %s ID \"%s\" instead of \"%s\"; using identity \"%s:%s\"", user, protocol, id, info.ProtocolIDs[protocol], protocol, id))
+		return protocol + ":" + id
+	}
+	return user
+}
+
+// CanonicalUser returns the stable identity of the user; the name from the
+// UserRoster if the user's protocol ID is mapped there, otherwise their
+// handle. Plugins should use this instead of r.User for access checks and
+// keying per-user data in the brain; use r.User for talking to the user.
+func (r *Robot) CanonicalUser() string {
+	return canonicalUser(r.User)
+}
+
+// GetCanonicalUser returns the stable identity of any user, for plugins
+// acting on a user named in a command, e.g. an administrator resetting
+// somebody's credentials. A UserRoster name with a mapped protocol ID is
+// already canonical; anything else is taken to be a chat handle.
+func (r *Robot) GetCanonicalUser(user string) string {
+	robot.RLock()
+	info, inRoster := robot.userRoster[user]
+	protocol := robot.protocol
+	robot.RUnlock()
+	if inRoster && info.ProtocolIDs[protocol] != "" {
+		return user
+	}
+	return canonicalUser(user)
+}
@@ -0,0 +1,23 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestGetCanonicalUser(t *testing.T) {
+	startTestRobot(t, rosterConf, nil, map[string]string{"alice2": "U1", "alicek": "U9", "bob": "U2"})
+	r := &Robot{User: "root", Channel: "general"}
+	for _, tc := range []struct{ user, want string }{
+		{"alice2", "alicek"}, // a mapped user's current handle
+		{"alicek", "alicek"}, // a canonical name, even with somebody else using it as a handle
+		{"bob", "bob"},       // unmapped users keep their handle
+	} {
+		if got := r.GetCanonicalUser(tc.user); got != tc.want {
+			t.Errorf("GetCanonicalUser(%s) = %s, want %s", tc.user, got, tc.want)
+		}
+	}
+	// the sender's identity still guards against a borrowed handle
+	if got := (&Robot{User: "alicek"}).CanonicalUser(); got != "test:U9" {
+		t.Errorf("CanonicalUser for the handle alicek = %s, want test:U9", got)
+	}
+}
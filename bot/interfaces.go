@@ -14,6 +14,10 @@ type Handler interface {
 	// can hear. The channelName and userName should be human-readable,
 	// not internal representations. If channelName is blank, it's a direct message
 	IncomingMessage(channelName, userName, message string)
+	// IncomingEvent is called by the connector for protocol events other
+	// than messages, such as users joining or channels being created. The
+	// connector should use the standard Event* types where they apply.
+	IncomingEvent(ev Event)
 	// GetProtocolConfig unmarshals the ProtocolConfig section of gopherbot.json
 	// into a connector-provided struct
 	GetProtocolConfig(interface{}) error
@@ -60,7 +64,7 @@ type Connector interface {
 	// GetProtocolUserAttribute retrieves a piece of information about a user
 	// from the connector protocol, or "",!ok if the connector doesn't have the
 	// information. Plugins should normally call GetUserAttribute, which
-	// supplements protocol data with data from users.json.
+	// supplements protocol data with the UserRoster from gopherbot.yaml.
 	// The current attributes are:
 	// email, realName, firstName, lastName, phone, sms, connections
 	GetProtocolUserAttribute(user, attr string) (value string, ret RetVal)
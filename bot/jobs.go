@@ -0,0 +1,169 @@
+package bot
+
+/* jobs.go - every call to a plugin is tracked as a job, so administrators
+   can see what's running and cancel jobs that have gone astray. */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reasons for canceling a job, worded for telling the user their command
+// "was canceled <reason>"
+const (
+	cancelAdmin    = "by an administrator"
+	cancelShutdown = "because I'm shutting down"
+)
+
+// a job is a single invocation of callPlugin
+type job struct {
+	id        int                // sequential job number, for referring to the job in commands
+	plugin    string             // name of the plugin called
+	command   string             // command the plugin was called with
+	user      string             // user the plugin is running for
+	channel   string             // channel the plugin is running in, "" for a DM
+	queued    bool               // waiting for a free slot, see MaxConcurrentPlugins
+	started   time.Time          // when the job was queued, then when it started running
+	cancel    context.CancelFunc // cancels the job; external plugins are stopped, and Robot.Context() is cancelled
+	interrupt context.CancelFunc // only cancels Robot.Context(), for user interruptions and shutdown; nil while queued
+	reason    string             // why the job was canceled, one of the cancel* reasons
+}
+
+// startJob registers a new job, which is queued until run is called, and
+// returns it along with a context that's done when the job is canceled.
+// Registering the job before it gets a slot to run lets administrators see
+// and cancel queued jobs.
+func startJob(bot *Robot, plugin *Plugin, command string) (j *job, ctx context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j = &job{
+		plugin:  plugin.name,
+		command: command,
+		user:    bot.User,
+		channel: bot.Channel,
+		queued:  true,
+		started: time.Now(),
+		cancel:  cancel,
+	}
+	pluginsRunning.Lock()
+	if pluginsRunning.jobs == nil {
+		pluginsRunning.jobs = make(map[int]*job)
+	}
+	pluginsRunning.nextJobID++
+	j.id = pluginsRunning.nextJobID
+	pluginsRunning.jobs[j.id] = j
+	pluginsRunning.Unlock()
+	return j, ctx
+}
+
+// run marks a job as running, starting it's timeout, and returns two
+// contexts derived from the job's context: ctx is done when the job is
+// canceled or times out, and rctx (for Robot.Context()) is additionally
+// cancelled when the user interrupts or the robot starts shutting down.
+func (j *job) run(jctx context.Context, timeout time.Duration) (ctx, rctx context.Context) {
+	ctx = jctx
+	pluginsRunning.Lock()
+	defer pluginsRunning.Unlock()
+	if timeout > 0 {
+		var tcancel context.CancelFunc
+		ctx, tcancel = context.WithTimeout(ctx, timeout)
+		cancel := j.cancel
+		j.cancel = func() {
+			tcancel()
+			cancel()
+		}
+	}
+	rctx, j.interrupt = context.WithCancel(ctx)
+	j.queued = false
+	j.started = time.Now()
+	// a job started during shutdown (e.g. abort) should know right away;
+	// shutdown hooks get to finish what they're doing, though.
+	if pluginsRunning.shuttingDown && j.command != "shutdown" {
+		j.interrupt()
+	}
+	return ctx, rctx
+}
+
+// finish removes a completed job from the list of running jobs
+func (j *job) finish() {
+	pluginsRunning.Lock()
+	delete(pluginsRunning.jobs, j.id)
+	interrupt, cancel := j.interrupt, j.cancel
+	pluginsRunning.Unlock()
+	if interrupt != nil {
+		interrupt()
+	}
+	cancel()
+}
+
+func (j *job) String() string {
+	channel := j.channel
+	if channel == "" {
+		channel = "(direct message)"
+	}
+	state := "running"
+	if j.queued {
+		state = "queued"
+	}
+	return fmt.Sprintf("Job %d: plugin \"%s\", command \"%s\", user \"%s\", channel \"%s\", %s for %v", j.id, j.plugin, j.command, j.user, channel, state, time.Since(j.started).Round(time.Second))
+}
+
+// cancelReason returns why a canceled job was canceled
+func (j *job) cancelReason() string {
+	pluginsRunning.Lock()
+	defer pluginsRunning.Unlock()
+	if j.reason == "" {
+		return cancelAdmin
+	}
+	return j.reason
+}
+
+// listJobs returns a copy of the currently running and queued jobs, ordered
+// by job ID
+func listJobs() []job {
+	pluginsRunning.Lock()
+	jobs := make([]job, 0, len(pluginsRunning.jobs))
+	for _, j := range pluginsRunning.jobs {
+		jobs = append(jobs, *j)
+	}
+	pluginsRunning.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].id < jobs[j].id })
+	return jobs
+}
+
+// cancelJob cancels a running or queued job, recording the reason for
+// telling the user. External plugins have their process group terminated;
+// Go plugins see their Robot.Context() cancelled.
+func cancelJob(id int, reason string) (job, bool) {
+	pluginsRunning.Lock()
+	j, ok := pluginsRunning.jobs[id]
+	var jc job
+	if ok {
+		j.reason = reason
+		jc = *j
+	}
+	pluginsRunning.Unlock()
+	if !ok {
+		return job{}, false
+	}
+	jc.cancel()
+	return jc, true
+}
+
+// interruptJobs cancels the Robot.Context() for every running job, called
+// when the robot starts shutting down. External plugins aren't stopped, since
+// the robot waits for them to finish; queued jobs are canceled, since they
+// won't be run.
+func interruptJobs() {
+	pluginsRunning.Lock()
+	for _, j := range pluginsRunning.jobs {
+		if j.interrupt != nil {
+			j.interrupt()
+		} else if j.queued {
+			j.reason = cancelShutdown
+			j.cancel()
+		}
+	}
+	pluginsRunning.Unlock()
+}
@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+const blockerConf = `
+AllChannels: true
+CommandMatchers:
+- Command: block
+  Regex: '(?i:block)'
+`
+
+// waitForJobs waits until there are running and queued blocker jobs, and
+// returns the queued ones
+func waitForJobs(t *testing.T, running, queued int) []job {
+	t.Helper()
+	deadline := time.Now().Add(messageTimeout)
+	for time.Now().Before(deadline) {
+		var r, q []job
+		for _, j := range listJobs() {
+			if j.plugin != "blocker" {
+				continue
+			}
+			if j.queued {
+				q = append(q, j)
+			} else {
+				r = append(r, j)
+			}
+		}
+		if len(r) == running && len(q) == queued {
+			return q
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Didn't get %d running and %d queued jobs: %v", running, queued, listJobs())
+	return nil
+}
+
+// Users are told why their queued command was canceled.
+func TestQueuedJobCancelReason(t *testing.T) {
+	release := make(chan struct{})
+	pluginHandlers["blocker"] = PluginHandler{DefaultConfig: blockerConf, Handler: func(bot *Robot, command string, args ...string) (retval PlugRetVal) {
+		if command == "block" {
+			select {
+			case <-release:
+			case <-bot.Context().Done():
+			}
+		}
+		return
+	}}
+	defer delete(pluginHandlers, "blocker")
+	tc := startTestRobot(t, rosterConf+"MaxConcurrentPlugins: 1\n", nil, nil)
+
+	// shutting down cancels queued jobs, and interrupts running ones
+	send("general", "alice", "floyd, block")
+	waitForJobs(t, 1, 0)
+	send("general", "bob", "floyd, block")
+	waitForJobs(t, 1, 1)
+	interruptJobs()
+	tc.expect(t, "bob: Sorry, your queued \"block\" command was canceled because I'm shutting down")
+	waitForJobs(t, 0, 0)
+
+	send("general", "alice", "floyd, block")
+	waitForJobs(t, 1, 0)
+	send("general", "bob", "floyd, block")
+	queued := waitForJobs(t, 1, 1)
+	send("general", "root", "floyd, cancel job "+strconv.Itoa(queued[0].id))
+	tc.expect(t, "bob: Sorry, your queued \"block\" command was canceled by an administrator")
+	close(release)
+	waitForJobs(t, 0, 0)
+}
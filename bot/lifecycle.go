@@ -0,0 +1,172 @@
+package bot
+
+/* lifecycle.go - plugins are called with "init" at startup, "reload" when
+   the configuration is reloaded, and "shutdown" before the robot exits.
+   DependsOn orders the calls: a plugin is initialized after the plugins it
+   depends on, and shut down before them. */
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How long a lifecycle hook can run when the plugin doesn't set InitTimeout
+const defaultHookTimeout = 30 * time.Second
+
+// isLifecycleHook returns true for the init, reload and shutdown commands
+func isLifecycleHook(command string) bool {
+	return command == "init" || command == "reload" || command == "shutdown"
+}
+
+// hookTimeout returns how long a plugin has to finish a lifecycle hook
+func (plugin *Plugin) hookTimeout() time.Duration {
+	if plugin.InitTimeout > 0 {
+		return time.Duration(plugin.InitTimeout) * time.Second
+	}
+	return defaultHookTimeout
+}
+
+// hookOrder returns, for each plugin, the plugins whose hooks have to finish
+// first. Unknown dependencies are ignored, and plugins in a dependency cycle
+// are run without ordering.
+func hookOrder(plugins []*Plugin, reverse bool) map[string][]string {
+	loaded := make(map[string]bool)
+	for _, plugin := range plugins {
+		loaded[plugin.name] = true
+	}
+	waitFor := make(map[string][]string)
+	for _, plugin := range plugins {
+		for _, dep := range plugin.DependsOn {
+			if !loaded[dep] {
+				Log(Warn, fmt.Sprintf("Plugin \"%s\" depends on \"%s\", which isn't loaded; ignoring", plugin.name, dep))
+				continue
+			}
+			if reverse {
+				waitFor[dep] = append(waitFor[dep], plugin.name)
+			} else {
+				waitFor[plugin.name] = append(waitFor[plugin.name], dep)
+			}
+		}
+	}
+	// A plugin is in a cycle if it can reach itself
+	var reaches func(from, to string, seen map[string]bool) bool
+	reaches = func(from, to string, seen map[string]bool) bool {
+		for _, dep := range waitFor[from] {
+			if dep == to {
+				return true
+			}
+			if !seen[dep] {
+				seen[dep] = true
+				if reaches(dep, to, seen) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	cyclic := make(map[string]bool)
+	for name := range waitFor {
+		if reaches(name, name, make(map[string]bool)) {
+			cyclic[name] = true
+		}
+	}
+	if len(cyclic) > 0 {
+		names := make([]string, 0, len(cyclic))
+		for name := range cyclic {
+			names = append(names, name)
+			// drop the dependencies that make up the cycle
+			kept := make([]string, 0, len(waitFor[name]))
+			for _, dep := range waitFor[name] {
+				if !cyclic[dep] {
+					kept = append(kept, dep)
+				}
+			}
+			waitFor[name] = kept
+		}
+		sort.Strings(names)
+		Log(Error, fmt.Sprintf("Dependency cycle in DependsOn for plugins: %v; ordering between these plugins is ignored", names))
+	}
+	return waitFor
+}
+
+// runHooks calls every plugin with a lifecycle command, in dependency order
+// (reversed for shutdown), and returns when all the hooks have finished or
+// timed out. Builtins only get "init", since the admin plugin has it's own
+// reload command.
+func runHooks(command string) {
+	currentPlugins.RLock()
+	plugins := currentPlugins.p
+	currentPlugins.RUnlock()
+	robot.RLock()
+	botName := robot.name
+	robot.RUnlock()
+	waitFor := hookOrder(plugins, command == "shutdown")
+	done := make(map[string]chan struct{})
+	for _, plugin := range plugins {
+		done[plugin.name] = make(chan struct{})
+	}
+	for _, plugin := range plugins {
+		go func(plugin *Plugin) {
+			defer close(done[plugin.name])
+			for _, dep := range waitFor[plugin.name] {
+				<-done[dep]
+			}
+			if plugin.pluginType == plugBuiltin && command != "init" {
+				return
+			}
+			bot := &Robot{
+				User:    botName,
+				Channel: "",
+				Format:  Variable,
+			}
+			timeout := plugin.hookTimeout()
+			Log(Info, fmt.Sprintf("Calling \"%s\" for plugin: %s", command, plugin.name))
+			finished := make(chan struct{})
+			go func() {
+				callPlugin(bot, plugin, false, false, command)
+				close(finished)
+			}()
+			// callPlugin stops external plugins at the timeout, but Go
+			// plugins have to notice their context was cancelled
+			select {
+			case <-finished:
+			case <-time.After(timeout + killGracePeriod):
+				Log(Error, fmt.Sprintf("Plugin \"%s\" didn't finish \"%s\" within %v, continuing without it", plugin.name, command, timeout))
+			}
+		}(plugin)
+	}
+	for _, plugin := range plugins {
+		<-done[plugin.name]
+	}
+	Log(Debug, fmt.Sprintf("Finished calling \"%s\" for all plugins", command))
+}
+
+// initializePlugins sends the "init" command to every plugin at startup
+func initializePlugins() {
+	pluginsRunning.Lock()
+	shuttingDown := pluginsRunning.shuttingDown
+	pluginsRunning.Unlock()
+	if !shuttingDown {
+		go runHooks("init")
+	}
+}
+
+// reloadPlugins sends the "reload" command to every plugin after the
+// configuration is reloaded
+func reloadPlugins() {
+	pluginsRunning.Lock()
+	shuttingDown := pluginsRunning.shuttingDown
+	pluginsRunning.Unlock()
+	if !shuttingDown {
+		go runHooks("reload")
+	}
+}
+
+// shutdownPlugins sends the "shutdown" command to every plugin and waits
+// for them to finish; called after all other plugins have stopped, and
+// before the brain exits.
+func shutdownPlugins() {
+	Log(Info, "Calling shutdown hooks for all plugins")
+	runHooks("shutdown")
+}
@@ -0,0 +1,250 @@
+package bot
+
+/* middleware.go - a chain of filters run on every incoming message before
+   it's dispatched. Go plugins register middleware with RegisterMiddleware;
+   external plugins can act as filters, called with a command of "filter".
+   The order is set by Middleware in gopherbot.yaml. */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long an external filter plugin can run, unless the plugin sets a Timeout
+const defaultFilterTimeout = 5 * time.Second
+
+// Message is an incoming message passed through the middleware chain.
+// Middleware can rewrite Text and add Annotations, which are made available
+// to plugins via Robot.Annotations().
+type Message struct {
+	User        string            // The user who sent the message
+	Channel     string            // The channel, or "" for a direct message
+	Text        string            // The message text, minus the robot's name or alias for commands
+	IsCommand   bool              // Whether the message was directed at the robot
+	Annotations map[string]string // Arbitrary key/value annotations
+}
+
+// Middleware is called for each incoming message, and returns false to stop
+// processing; middleware that stops a message would normally use the Robot
+// to reply with the reason.
+type Middleware func(bot *Robot, msg *Message) (proceed bool)
+
+var middlewares = struct {
+	m map[string]Middleware
+	sync.Mutex
+}{
+	make(map[string]Middleware),
+	sync.Mutex{},
+}
+
+// RegisterMiddleware allows Go plugins to register Middleware in a func
+// init(). Registered middleware only runs when it's name is listed in
+// Middleware in gopherbot.yaml.
+func RegisterMiddleware(name string, m Middleware) {
+	if stopRegistrations {
+		return
+	}
+	middlewares.Lock()
+	defer middlewares.Unlock()
+	if _, exists := middlewares.m[name]; exists {
+		log.Fatal("Attempted registration of duplicate middleware name:", name)
+	}
+	middlewares.m[name] = m
+}
+
+// runMiddleware passes a message through the configured middleware chain,
+// returning false if the message shouldn't be processed further.
+func runMiddleware(msg *Message) bool {
+	robot.RLock()
+	chain := robot.middleware
+	robot.RUnlock()
+	if len(chain) == 0 {
+		return true
+	}
+	bot := &Robot{
+		User:    msg.User,
+		Channel: msg.Channel,
+		Format:  Variable,
+	}
+	for _, name := range chain {
+		middlewares.Lock()
+		m, isGo := middlewares.m[name]
+		middlewares.Unlock()
+		var proceed bool
+		if isGo {
+			proceed = callGoMiddleware(bot, name, m, msg)
+		} else {
+			currentPlugins.RLock()
+			_, exists := currentPlugins.nameMap[name]
+			currentPlugins.RUnlock()
+			if !exists {
+				Log(Error, fmt.Sprintf("Middleware \"%s\" isn't a registered Go middleware or a loaded plugin, skipping", name))
+				continue
+			}
+			proceed = callFilterPlugin(bot, currentPlugins.getPluginByName(name), msg)
+		}
+		if !proceed {
+			Log(Debug, fmt.Sprintf("Middleware \"%s\" stopped processing of message \"%s\" from user \"%s\" in channel \"%s\"", name, msg.Text, msg.User, msg.Channel))
+			return false
+		}
+	}
+	return true
+}
+
+// callGoMiddleware calls Go middleware, recovering from panics; a panic lets
+// the message through.
+func callGoMiddleware(bot *Robot, name string, m Middleware, msg *Message) (proceed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log(Error, fmt.Sprintf("PANIC from middleware \"%s\": %s", name, r))
+			proceed = true
+		}
+	}()
+	return m(bot, msg)
+}
+
+// callFilterPlugin runs an external plugin as a filter, with a command of
+// "filter" and arguments of "command" or "ambient" and the message text.
+// Previous annotations are passed as GOPHER_ANNOTATION_<KEY> environment
+// variables. The plugin can write lines to stdout to change the message:
+//
+//	text <new message text>
+//	annotate <key> <value>
+//
+// Exit status 0 (Normal) lets the message through, 2 (Fail) stops
+// processing; anything else is logged, and the message passes through
+// unchanged.
+func callFilterPlugin(bot *Robot, plugin *Plugin, msg *Message) bool {
+	if plugin.pluginType != plugExternal {
+		Log(Error, fmt.Sprintf("Middleware plugin \"%s\" isn't an external plugin; use RegisterMiddleware for Go plugins", plugin.name))
+		return true
+	}
+	if plugin.Disabled {
+		return true
+	}
+	fullPath, err := getPluginPath(plugin)
+	if err != nil {
+		return true
+	}
+	msgType := "ambient"
+	if msg.IsCommand {
+		msgType = "command"
+	}
+	args := make([]string, 0, 4)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		interpreter, err := getInterpreter(fullPath)
+		if err != nil {
+			Log(Error, fmt.Sprintf("Unable to call filter plugin %s, no interpreter found: %s", fullPath, err))
+			return true
+		}
+		args = append(args, fullPath, "filter", msgType, msg.Text)
+		cmd = exec.Command(interpreter, fixInterpreterArgs(interpreter, args)...)
+	} else {
+		args = append(args, "filter", msgType, msg.Text)
+		cmd = exec.Command(fullPath, args...)
+	}
+	cmd.Env = append(os.Environ(), []string{
+		fmt.Sprintf("GOPHER_CHANNEL=%s", msg.Channel),
+		fmt.Sprintf("GOPHER_USER=%s", msg.User),
+		fmt.Sprintf("GOPHER_PLUGIN_ID=%s", plugin.pluginID),
+	}...)
+	cmd.Env = append(cmd.Env, annotationsEnv(msg.Annotations)...)
+	setProcGroup(cmd)
+	if plugin.sandbox != nil {
+		cleanup, err := sandboxCommand(cmd, plugin.name, plugin.sandbox)
+		if err != nil {
+			Log(Error, fmt.Errorf("Sandboxing filter plugin \"%s\", letting the message through: %v", plugin.name, err))
+			return true
+		}
+		defer cleanup()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	timeout := defaultFilterTimeout
+	if plugin.Timeout > 0 {
+		timeout = time.Duration(plugin.Timeout) * time.Second
+	}
+	Log(Debug, fmt.Sprintf("Calling filter plugin \"%s\" with args: %q", plugin.name, args))
+	if err = cmd.Start(); err != nil {
+		Log(Error, fmt.Errorf("Starting filter plugin \"%s\": %v", fullPath, err))
+		return true
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		Log(Error, fmt.Sprintf("Filter plugin \"%s\" didn't finish within %v, letting the message through", plugin.name, timeout))
+		termProcGroup(cmd)
+		select {
+		case <-done:
+		case <-time.After(killGracePeriod):
+			killProcGroup(cmd)
+			<-done
+		}
+		return true
+	}
+	if stderr.Len() > 0 {
+		Log(Warn, fmt.Errorf("Output from stderr of filter plugin \"%s\": %s", fullPath, stderr.String()))
+	}
+	if err != nil {
+		if exitstatus, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitstatus.Sys().(syscall.WaitStatus); ok && PlugRetVal(status.ExitStatus()) == Fail {
+				return false
+			}
+		}
+		Log(Error, fmt.Errorf("Filter plugin \"%s\" failed, letting the message through: %v", fullPath, err))
+		return true
+	}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "text "):
+			msg.Text = strings.TrimPrefix(line, "text ")
+		case strings.HasPrefix(line, "annotate "):
+			kv := strings.SplitN(strings.TrimPrefix(line, "annotate "), " ", 2)
+			if len(kv) == 2 {
+				msg.Annotations[kv[0]] = kv[1]
+			} else {
+				msg.Annotations[kv[0]] = ""
+			}
+		case line == "":
+		default:
+			Log(Warn, fmt.Sprintf("Ignoring unknown output from filter plugin \"%s\": %s", plugin.name, line))
+		}
+	}
+	return true
+}
+
+// annotationsEnv returns GOPHER_ANNOTATION_<KEY>=<value> environment
+// variables for external plugins
+func annotationsEnv(annotations map[string]string) []string {
+	env := make([]string, 0, len(annotations))
+	for key, value := range annotations {
+		envName := envNameRe.ReplaceAllString(strings.ToUpper(key), "_")
+		env = append(env, fmt.Sprintf("GOPHER_ANNOTATION_%s=%s", envName, value))
+	}
+	return env
+}
+
+// Annotations returns the annotations middleware added to the message that
+// triggered the plugin.
+func (r *Robot) Annotations() map[string]string {
+	annotations := make(map[string]string, len(r.annotations))
+	for key, value := range r.annotations {
+		annotations[key] = value
+	}
+	return annotations
+}
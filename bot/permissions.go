@@ -0,0 +1,118 @@
+package bot
+
+/* permissions.go - role-based access control. Roles in gopherbot.yaml
+   grant named permissions to users and to members of Groups; the builtin
+   administrative commands each check a specific permission, and plugins
+   can define and check their own. AdminUsers have every permission. */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permissions checked by the builtin plugins; the ones used with
+// RequirePermission are referenced in builtinsDefaultConfig.go
+const (
+	PermReload       = "reload"           // reload configuration
+	PermShutdown     = "shutdown"         // quit and abort
+	PermJobs         = "jobs"             // list and cancel running jobs
+	PermLogs         = "logs"             // view logs and change the log level
+	PermPluginManage = "plugin.manage"    // list plugins and dump configuration
+	PermGroupsManage = "groups.manage"    // add and remove group members
+	PermElevation    = "elevation.manage" // list and revoke elevation sessions
+)
+
+// Role grants a set of permissions to users, and members of groups
+type Role struct {
+	Permissions []string // Permissions granted by the role; "*" grants all permissions
+	Users       []string // Users with the role
+	Groups      []string // Groups from Groups whose members have the role
+}
+
+// grants checks whether the role grants a permission; a trailing ".*"
+// grants every permission with that prefix, e.g. "deploy.*"
+func (role Role) grants(perm string) bool {
+	for _, p := range role.Permissions {
+		if p == "*" || p == perm {
+			return true
+		}
+		if strings.HasSuffix(p, ".*") && strings.HasPrefix(perm, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin checks whether the user is listed in AdminUsers
+func isAdmin(user string) bool {
+	robot.RLock()
+	defer robot.RUnlock()
+	for _, adminUser := range robot.adminUsers {
+		if user == adminUser {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission checks whether a user has a permission from any of their
+// roles.
+func hasPermission(user, perm string) bool {
+	if isAdmin(user) {
+		return true
+	}
+	robot.RLock()
+	roles := robot.roles
+	robot.RUnlock()
+	var groups map[string][]string
+	var changes map[string]groupChanges
+	groupsOk := true
+	for name, role := range roles {
+		if !role.grants(perm) {
+			continue
+		}
+		for _, u := range role.Users {
+			if u == user {
+				Log(Trace, fmt.Sprintf("User \"%s\" has permission \"%s\" from role \"%s\"", user, perm, name))
+				return true
+			}
+		}
+		if len(role.Groups) == 0 || !groupsOk {
+			continue
+		}
+		if changes == nil {
+			var ret RetVal
+			if changes, ret = loadGroupChanges(); ret != Ok {
+				// members may have been removed at runtime, so fail closed
+				groupsOk = false
+				continue
+			}
+			groups = configuredGroups()
+		}
+		for _, group := range role.Groups {
+			if inGroup(groups, changes, user, group, make(map[string]bool)) {
+				Log(Trace, fmt.Sprintf("User \"%s\" has permission \"%s\" from role \"%s\" through group \"%s\"", user, perm, name, group))
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if the user has been granted the named
+// permission by a role in gopherbot.yaml, or is an administrator. Plugins
+// can check their own permissions, e.g. "deploy.production".
+func (r *Robot) HasPermission(perm string) bool {
+	return hasPermission(r.CanonicalUser(), perm)
+}
+
+// checkPermission replies to the user and returns false if they don't have
+// the permission.
+func (bot *Robot) checkPermission(perm string) bool {
+	if bot.HasPermission(perm) {
+		return true
+	}
+	Log(Audit, fmt.Sprintf("User \"%s\" denied permission \"%s\" in channel \"%s\"", bot.User, perm, bot.Channel))
+	bot.Reply(fmt.Sprintf("Sorry, that requires the \"%s\" permission", perm))
+	return false
+}
@@ -78,6 +78,10 @@ type InputMatcher struct {
 	Command  string         // The name of the command to pass to the plugin with it's arguments
 	Label    string         // ReplyMatchers use "Label" instead of "Command"
 	Contexts []string       // label the contexts corresponding to capture groups, for supporting "it" & optional args
+	Timeout  int            // Seconds the plugin may run this command; overrides the plugin Timeout
+	Cooldown int            // Seconds after this command runs in a channel before it can run there again
+	Priority int            // When a command matches more than one plugin, the highest Priority wins; ties are resolved by asking the user
+	Args     []ArgSpec      // Types and defaults for named capture groups
 	re       *regexp.Regexp // The compiled regular expression. If the regex doesn't compile, the 'bot will log an error
 }
 
@@ -91,33 +95,47 @@ const (
 
 // Plugin specifies the structure of a plugin configuration - plugins should include an example / default config
 type Plugin struct {
-	name                     string          // the name of the plugin, used as a key in to the
-	pluginType               plugType        // plugGo, plugExternal, plugBuiltin - determines how commands are routed
-	pluginPath               string          // Path to the external executable that expects <channel> <user> <command> <arg> <arg> from regex matches - for Plugtype=plugExternal only
-	Disabled                 bool            // Set true to disable the plugin
-	AllowDirect              bool            // Set this true if this plugin can be accessed via direct message
-	DirectOnly               bool            // Set this true if this plugin ONLY accepts direct messages
-	DenyDirect               bool            // Set true to override global DefaultAllowDirect = true
-	Channels                 []string        // Channels where the plugin is active - rifraf like "memes" should probably only be in random, but it's configurable. If empty uses DefaultChannels
-	AllChannels              bool            // If the Channels list is empty and AllChannels is true, the plugin should be active in all the channels the bot is in
-	RequireAdmin             bool            // Set to only allow administrators to access a plugin
-	Elevator                 string          // Use an elevator other than the DefaultElevator
-	ElevatedCommands         []string        // Commands that require elevation, usually via 2fa
-	ElevateImmediateCommands []string        // Commands that always require elevation promting, regardless of timeouts
-	Users                    []string        // If non-empty, list of all the users with access to this plugin
-	TrustedPlugins           []string        // list of plugins allowed to call this one
-	Authorizer               string          // a plugin to call for authorizing users, should handle groups, etc.
-	AuthRequire              string          // an optional group/role name to be passed to the Authorizer plugin, for group/role-based authorization determination
-	AuthorizedCommands       []string        // Which commands to authorize
-	AuthorizeAllCommands     bool            // when ALL commands need to be authorized
-	Help                     []PluginHelp    // All the keyword sets / help texts for this plugin
-	CommandMatchers          []InputMatcher  // Input matchers for messages that need to be directed to the 'bot
-	ReplyMatchers            []InputMatcher  // Input matchers for replies to questions, only match after a RequestContinuation
-	MessageMatchers          []InputMatcher  // Input matchers for messages the 'bot hears even when it's not being spoken to
-	CatchAll                 bool            // Whenever the robot is spoken to, but no plugin matches, plugins with CatchAll=true get called with command="catchall" and argument=<full text of message to robot>
-	Config                   json.RawMessage // Arbitrary Plugin configuration, will be stored and provided in a thread-safe manner via GetPluginConfig()
-	config                   interface{}     // A pointer to an empty struct that the bot can Unmarshal custom configuration into
-	pluginID                 string          // 32-char random ID for identifying plugins in callbacks
+	name                     string            // the name of the plugin, used as a key in to the
+	pluginType               plugType          // plugGo, plugExternal, plugBuiltin - determines how commands are routed
+	pluginPath               string            // Path to the external executable that expects <channel> <user> <command> <arg> <arg> from regex matches - for Plugtype=plugExternal only
+	sandbox                  *Sandbox          // Restrictions on the external plugin's process, from ExternalPlugins
+	Disabled                 bool              // Set true to disable the plugin
+	AllowDirect              bool              // Set this true if this plugin can be accessed via direct message
+	DirectOnly               bool              // Set this true if this plugin ONLY accepts direct messages
+	DenyDirect               bool              // Set true to override global DefaultAllowDirect = true
+	Channels                 []string          // Channels where the plugin is active - rifraf like "memes" should probably only be in random, but it's configurable. If empty uses DefaultChannels
+	AllChannels              bool              // If the Channels list is empty and AllChannels is true, the plugin should be active in all the channels the bot is in
+	RequireAdmin             bool              // Set to only allow administrators to access a plugin
+	RequirePermission        string            // Only allow users with this permission (see Roles) to access a plugin
+	Elevator                 string            // Use an elevator other than the DefaultElevator
+	ElevatedCommands         []string          // Commands that require elevation, usually via 2fa
+	ElevateImmediateCommands []string          // Commands that always require elevation promting, regardless of timeouts
+	ConfirmCommands          []string          // Commands that require the user to confirm with a yes/no reply before running
+	ConfirmPrompt            string            // Prompt for ConfirmCommands; (command) and (args) are replaced with the command and it's arguments
+	ApprovalCommands         []string          // Commands that only run after another member of the ApprovalGroup approves them
+	ApprovalGroup            string            // Group from Groups in gopherbot.yaml whose members can approve ApprovalCommands
+	CommandAuthRequire       map[string]string // Commands requiring authorization, mapped to the AuthRequire value for each
+	Users                    []string          // If non-empty, list of all the users with access to this plugin
+	TrustedPlugins           []string          // list of plugins allowed to call this one
+	Authorizer               string            // a plugin to call for authorizing users, should handle groups, etc.
+	AuthRequire              string            // an optional group/role name to be passed to the Authorizer plugin, for group/role-based authorization determination
+	AuthorizedCommands       []string          // Which commands to authorize
+	AuthorizeAllCommands     bool              // when ALL commands need to be authorized
+	Help                     []PluginHelp      // All the keyword sets / help texts for this plugin
+	CommandMatchers          []InputMatcher    // Input matchers for messages that need to be directed to the 'bot
+	ReplyMatchers            []InputMatcher    // Input matchers for replies to questions, only match after a RequestContinuation
+	MessageMatchers          []InputMatcher    // Input matchers for messages the 'bot hears even when it's not being spoken to
+	EventSubscriptions       []string          // Event types the plugin is called for, with command "event:<type>"; "*" for all events
+	CatchAll                 bool              // Whenever the robot is spoken to, but no plugin matches, plugins with CatchAll=true get called with command="catchall" and argument=<full text of message to robot>
+	MaxConcurrent            int               // Maximum number of jobs for this plugin that can run at once; more are queued. 0 = unlimited
+	SingleInstance           bool              // Never run more than one job for this plugin; new requests are refused while it's running
+	RateLimits               []RateLimit       // Limits on how often commands for this plugin can be run
+	DependsOn                []string          // Plugins that must finish init before this one, and shutdown after it
+	InitTimeout              int               // Seconds the plugin has to finish an init, reload or shutdown hook; default 30
+	Timeout                  int               // Seconds a plugin may run before external plugins are killed and Go plugins cancelled; 0 means no timeout
+	Config                   json.RawMessage   // Arbitrary Plugin configuration, will be stored and provided in a thread-safe manner via GetPluginConfig()
+	config                   interface{}       // A pointer to an empty struct that the bot can Unmarshal custom configuration into
+	pluginID                 string            // 32-char random ID for identifying plugins in callbacks
 }
 
 // PluginHandler is the struct a plugin registers for the Gopherbot plugin API.
@@ -134,28 +152,6 @@ var pluginHandlers = make(map[string]PluginHandler)
 // stopRegistrations is set "true" when the bot is created to prevent registration outside of init functions
 var stopRegistrations = false
 
-// initialize sends the "init" command to every plugin
-func initializePlugins() {
-	currentPlugins.RLock()
-	plugins := currentPlugins.p
-	currentPlugins.RUnlock()
-	pluginsRunning.Lock()
-	if !pluginsRunning.shuttingDown {
-		pluginsRunning.Unlock()
-		for _, plugin := range plugins {
-			bot := &Robot{
-				User:    robot.name,
-				Channel: "",
-				Format:  Variable,
-			}
-			Log(Info, "Initializing plugin:", plugin.name)
-			go callPlugin(bot, plugin, false, false, "init")
-		}
-	} else {
-		pluginsRunning.Unlock()
-	}
-}
-
 // Update passed-in regex so that a space can match a variable # of spaces
 func massageRegexp(r string) string {
 	replaceSpaceRe := regexp.MustCompile(`\[([^]]*) ([^]]*)\]`)
@@ -195,12 +191,15 @@ func loadPluginConfig() {
 	nump := len(pluginHandlers) + len(robot.externalPlugins)
 	pnames := make([]string, nump)
 	ptypes := make([]plugType, nump)
-	eppaths := make(map[string]string) // Paths to external plugins
+	eppaths := make(map[string]string)       // Paths to external plugins
+	epsandboxes := make(map[string]*Sandbox) // Sandboxes for external plugins
 	plugIndexByID := make(map[string]int)
 	plugIndexByName := make(map[string]int)
 	pset := make(map[string]bool) // track plugin names
 
 	defaultAllowDirect := robot.defaultAllowDirect
+	approvalGroups := robot.approvalGroups
+	groups := robot.groups
 
 	// builtins come first so indexes match, see loop below
 	// Note this doesn't need to be under RLock, but it needs to precede
@@ -232,6 +231,7 @@ func loadPluginConfig() {
 		pset[plug.Name] = true
 		ptypes[i] = plugExternal
 		eppaths[plug.Name] = plug.Path
+		epsandboxes[plug.Name] = plug.Sandbox
 		i++
 	}
 	// shrink slices when plugins were skipped
@@ -284,7 +284,9 @@ PlugLoop:
 		plugin.pluginType = ptypes[i]
 		if plugin.pluginType == plugExternal {
 			// External plugins spit their default config to stdout when called with command="configure"
+			plugin.name = plug
 			plugin.pluginPath = eppaths[plug]
+			plugin.sandbox = epsandboxes[plug]
 			cfg, err := getExtDefCfg(plugin)
 			if err != nil {
 				Log(Error, err)
@@ -319,20 +321,29 @@ PlugLoop:
 		for key, value := range pcfgload {
 			var strval string
 			var boolval bool
+			var intval int
 			var sarrval []string
 			var hval []PluginHelp
 			var mval []InputMatcher
+			var rlval []RateLimit
+			var cmdmval map[string]string
 			var val interface{}
 			skip := false
 			switch key {
-			case "Elevator", "Authorizer", "AuthRequire":
+			case "Elevator", "Authorizer", "AuthRequire", "ConfirmPrompt", "ApprovalGroup", "RequirePermission":
 				val = &strval
-			case "Disabled", "AllowDirect", "DirectOnly", "DenyDirect", "AllChannels", "RequireAdmin", "AuthorizeAllCommands", "CatchAll":
+			case "Disabled", "AllowDirect", "DirectOnly", "DenyDirect", "AllChannels", "RequireAdmin", "AuthorizeAllCommands", "CatchAll", "SingleInstance":
 				val = &boolval
-			case "Channels", "ElevatedCommands", "ElevateImmediateCommands", "Users", "TrustedPlugins", "AuthorizedCommands":
+			case "Timeout", "MaxConcurrent", "InitTimeout":
+				val = &intval
+			case "Channels", "ElevatedCommands", "ElevateImmediateCommands", "Users", "TrustedPlugins", "AuthorizedCommands", "EventSubscriptions", "DependsOn", "ConfirmCommands", "ApprovalCommands":
 				val = &sarrval
 			case "Help":
 				val = &hval
+			case "RateLimits":
+				val = &rlval
+			case "CommandAuthRequire":
+				val = &cmdmval
 			case "CommandMatchers", "ReplyMatchers", "MessageMatchers":
 				val = &mval
 			case "Config":
@@ -362,12 +373,28 @@ PlugLoop:
 				plugin.AllChannels = *(val.(*bool))
 			case "RequireAdmin":
 				plugin.RequireAdmin = *(val.(*bool))
+			case "RequirePermission":
+				plugin.RequirePermission = *(val.(*string))
 			case "Elevator":
 				plugin.Elevator = *(val.(*string))
+			case "ConfirmPrompt":
+				plugin.ConfirmPrompt = *(val.(*string))
+			case "ApprovalGroup":
+				plugin.ApprovalGroup = *(val.(*string))
 			case "ElevatedCommands":
 				plugin.ElevatedCommands = *(val.(*[]string))
 			case "ElevateImmediateCommands":
 				plugin.ElevateImmediateCommands = *(val.(*[]string))
+			case "EventSubscriptions":
+				plugin.EventSubscriptions = *(val.(*[]string))
+			case "DependsOn":
+				plugin.DependsOn = *(val.(*[]string))
+			case "ConfirmCommands":
+				plugin.ConfirmCommands = *(val.(*[]string))
+			case "ApprovalCommands":
+				plugin.ApprovalCommands = *(val.(*[]string))
+			case "CommandAuthRequire":
+				plugin.CommandAuthRequire = *(val.(*map[string]string))
 			case "Users":
 				plugin.Users = *(val.(*[]string))
 			case "TrustedPlugins":
@@ -390,6 +417,16 @@ PlugLoop:
 				plugin.MessageMatchers = *(val.(*[]InputMatcher))
 			case "CatchAll":
 				plugin.CatchAll = *(val.(*bool))
+			case "Timeout":
+				plugin.Timeout = *(val.(*int))
+			case "InitTimeout":
+				plugin.InitTimeout = *(val.(*int))
+			case "MaxConcurrent":
+				plugin.MaxConcurrent = *(val.(*int))
+			case "SingleInstance":
+				plugin.SingleInstance = *(val.(*bool))
+			case "RateLimits":
+				plugin.RateLimits = *(val.(*[]RateLimit))
 			case "Config":
 				plugin.Config = value
 			}
@@ -410,6 +447,10 @@ PlugLoop:
 				continue PlugLoop
 			}
 			command.re = re
+			if err := command.validateArgs(); err != nil {
+				Log(Error, fmt.Errorf("Skipping %s, %v", plug, err))
+				continue PlugLoop
+			}
 		}
 		for i := range plugin.ReplyMatchers {
 			reply := &plugin.ReplyMatchers[i]
@@ -432,6 +473,16 @@ PlugLoop:
 				continue PlugLoop
 			}
 			message.re = re
+			if err := message.validateArgs(); err != nil {
+				Log(Error, fmt.Errorf("Skipping %s, %v", plug, err))
+				continue PlugLoop
+			}
+		}
+		for _, rl := range plugin.RateLimits {
+			if err := rl.validate(); err != nil {
+				Log(Error, fmt.Errorf("Skipping %s, %v", plug, err))
+				continue PlugLoop
+			}
 		}
 		if len(plugin.ElevatedCommands) > 0 {
 			for _, i := range plugin.ElevatedCommands {
@@ -456,6 +507,37 @@ PlugLoop:
 				}
 			}
 		}
+		for _, c := range plugin.ConfirmCommands {
+			if !plugin.hasCommand(c) {
+				Log(Error, fmt.Errorf("Skipping %s, confirm command %s didn't match a command from CommandMatchers or MessageMatchers", plug, c))
+				continue PlugLoop
+			}
+		}
+		for c := range plugin.CommandAuthRequire {
+			if !plugin.hasCommand(c) {
+				Log(Error, fmt.Errorf("Skipping %s, CommandAuthRequire command %s didn't match a command from CommandMatchers or MessageMatchers", plug, c))
+				continue PlugLoop
+			}
+		}
+		if len(plugin.ApprovalCommands) > 0 {
+			if plugin.ApprovalGroup == "" {
+				Log(Error, fmt.Errorf("Skipping %s, ApprovalCommands specified without an ApprovalGroup", plug))
+				continue PlugLoop
+			}
+			if _, ok := groups[plugin.ApprovalGroup]; !ok {
+				if _, ok := approvalGroups[plugin.ApprovalGroup]; !ok {
+					Log(Error, fmt.Errorf("Skipping %s, ApprovalGroup %s isn't defined in Groups", plug, plugin.ApprovalGroup))
+					continue PlugLoop
+				}
+				Log(Warn, fmt.Sprintf("Plugin \"%s\" ApprovalGroup \"%s\" is from the deprecated ApprovalGroups; it should be moved to Groups", plug, plugin.ApprovalGroup))
+			}
+			for _, c := range plugin.ApprovalCommands {
+				if !plugin.hasCommand(c) {
+					Log(Error, fmt.Errorf("Skipping %s, approval command %s didn't match a command from CommandMatchers or MessageMatchers", plug, c))
+					continue PlugLoop
+				}
+			}
+		}
 		plugin.name = plug
 		// Copy the pointer to the empty config struct / empty struct (when no config)
 		pt := reflect.ValueOf(pluginHandlers[plug].Config)
@@ -492,20 +574,20 @@ PlugLoop:
 		plugIndex++
 	}
 
-	reInitPlugins := false
+	reloading := false
 	currentPlugins.Lock()
 	currentPlugins.p = plist
 	currentPlugins.idMap = plugIndexByID
 	currentPlugins.nameMap = plugIndexByName
 	currentPlugins.Unlock()
 	// loadPluginConfig is called in newBot, before the connector has started;
-	// don't init plugins in that case.
+	// plugins are initialized once it's running.
 	robot.Lock()
 	if robot.Connector != nil {
-		reInitPlugins = true
+		reloading = true
 	}
 	robot.Unlock()
-	if reInitPlugins {
-		initializePlugins()
+	if reloading {
+		reloadPlugins()
 	}
 }
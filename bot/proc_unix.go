@@ -0,0 +1,24 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package bot
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup puts an external plugin in it's own process group, so that
+// any children it spawns can be signalled along with it.
+func setProcGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// termProcGroup sends SIGTERM to the plugin's process group
+func termProcGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcGroup sends SIGKILL to the plugin's process group
+func killProcGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
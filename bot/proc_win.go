@@ -0,0 +1,21 @@
+// +build windows
+
+package bot
+
+import (
+	"os/exec"
+)
+
+// setProcGroup is a no-op on Windows
+func setProcGroup(cmd *exec.Cmd) {}
+
+// termProcGroup can't be done gracefully on Windows, so just kill
+// the process
+func termProcGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// killProcGroup kills the plugin process
+func killProcGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
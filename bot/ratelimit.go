@@ -0,0 +1,177 @@
+package bot
+
+/* ratelimit.go - per-user, per-channel and global rate limits for commands,
+   and per-command cooldowns. */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default reply when a command is rate limited; (wait) is replaced with how
+// long the user needs to wait
+const defaultRateLimitReply = "Sorry, that's been done too often lately - please try again in (wait)"
+
+// how often stale rate limit entries are swept out
+const rateSweepInterval = time.Minute
+
+// RateLimit allows at most Count invocations in a Window of seconds, counted
+// separately for each user, each channel, or globally, depending on Scope.
+type RateLimit struct {
+	Scope  string // one of "user", "channel" or "global"
+	Count  int    // maximum number of invocations in the window
+	Window int    // length of the window in seconds
+}
+
+// validate checks a RateLimit for obvious configuration errors
+func (rl RateLimit) validate() error {
+	switch rl.Scope {
+	case "user", "channel", "global":
+	default:
+		return fmt.Errorf("invalid RateLimit Scope \"%s\", must be one of user, channel or global", rl.Scope)
+	}
+	if rl.Count < 1 || rl.Window < 1 {
+		return fmt.Errorf("RateLimit for scope \"%s\" needs a positive Count and Window", rl.Scope)
+	}
+	return nil
+}
+
+// a rateKey identifies the invocations counted against a given limit;
+// plugin is empty for robot-wide limits
+type rateKey struct {
+	plugin, scope, id string
+	count, window     int
+}
+
+// a cooldownKey identifies a command cooling down in a channel
+type cooldownKey struct {
+	plugin, command, channel string
+}
+
+var rateLimits = struct {
+	invocations map[rateKey][]time.Time
+	cooldowns   map[cooldownKey]time.Time // when the cooldown expires
+	lastSweep   time.Time
+	sync.Mutex
+}{
+	make(map[rateKey][]time.Time),
+	make(map[cooldownKey]time.Time),
+	time.Now(),
+	sync.Mutex{},
+}
+
+// scopeID returns the identifier an invocation is counted against for a
+// given scope. For the channel scope, each user's DMs count as a separate
+// channel.
+func scopeID(scope, user, channel string) string {
+	switch scope {
+	case "user":
+		return user
+	case "channel":
+		if channel == "" {
+			return "(direct):" + user
+		}
+		return channel
+	}
+	return ""
+}
+
+// checkRateLimits checks robot and plugin rate limits and the command's
+// cooldown. If the command is allowed, the invocation is recorded; otherwise
+// it returns limited = true and how long the user should wait.
+func checkRateLimits(bot *Robot, plugin *Plugin, matcher InputMatcher) (wait time.Duration, limited bool) {
+	robot.RLock()
+	robotLimits := robot.rateLimits
+	robot.RUnlock()
+	now := time.Now()
+	keys := make([]rateKey, 0, len(robotLimits)+len(plugin.RateLimits))
+	for _, rl := range robotLimits {
+		keys = append(keys, rateKey{"", rl.Scope, scopeID(rl.Scope, bot.User, bot.Channel), rl.Count, rl.Window})
+	}
+	for _, rl := range plugin.RateLimits {
+		keys = append(keys, rateKey{plugin.name, rl.Scope, scopeID(rl.Scope, bot.User, bot.Channel), rl.Count, rl.Window})
+	}
+	ckey := cooldownKey{plugin.name, matcher.Command, scopeID("channel", bot.User, bot.Channel)}
+
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	if now.Sub(rateLimits.lastSweep) > rateSweepInterval {
+		sweepRateLimits(now)
+	}
+	if matcher.Cooldown > 0 {
+		if expires, ok := rateLimits.cooldowns[ckey]; ok {
+			remaining := expires.Sub(now)
+			if remaining > 0 {
+				Log(Debug, fmt.Sprintf("Command \"%s\" for plugin \"%s\" is cooling down in \"%s\" for another %v", matcher.Command, plugin.name, ckey.channel, remaining))
+				wait, limited = remaining, true
+			}
+		}
+	}
+	for _, key := range keys {
+		window := time.Duration(key.window) * time.Second
+		current := trimInvocations(rateLimits.invocations[key], now, window)
+		rateLimits.invocations[key] = current
+		if len(current) >= key.count {
+			remaining := window - now.Sub(current[0])
+			Log(Debug, fmt.Sprintf("Rate limit of %d per %ds for scope \"%s\" reached for plugin \"%s\" command \"%s\", user \"%s\" in channel \"%s\"", key.count, key.window, key.scope, plugin.name, matcher.Command, bot.User, bot.Channel))
+			if remaining > wait {
+				wait = remaining
+			}
+			limited = true
+		}
+	}
+	if limited {
+		return wait, true
+	}
+	for _, key := range keys {
+		rateLimits.invocations[key] = append(rateLimits.invocations[key], now)
+	}
+	if matcher.Cooldown > 0 {
+		rateLimits.cooldowns[ckey] = now.Add(time.Duration(matcher.Cooldown) * time.Second)
+	}
+	return 0, false
+}
+
+// trimInvocations drops invocations that have fallen out of the window
+func trimInvocations(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	return times[i:]
+}
+
+// sweepRateLimits removes stale entries; called with rateLimits locked.
+func sweepRateLimits(now time.Time) {
+	for key, times := range rateLimits.invocations {
+		current := trimInvocations(times, now, time.Duration(key.window)*time.Second)
+		if len(current) == 0 {
+			delete(rateLimits.invocations, key)
+		} else {
+			rateLimits.invocations[key] = current
+		}
+	}
+	for key, expires := range rateLimits.cooldowns {
+		if now.After(expires) {
+			delete(rateLimits.cooldowns, key)
+		}
+	}
+	rateLimits.lastSweep = now
+}
+
+// sendRateLimitReply politely tells the user to wait
+func sendRateLimitReply(bot *Robot, wait time.Duration) {
+	robot.RLock()
+	msg := robot.rateLimitReply
+	robot.RUnlock()
+	if msg == "" {
+		msg = defaultRateLimitReply
+	}
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	bot.Reply(strings.Replace(msg, "(wait)", wait.String(), -1))
+}
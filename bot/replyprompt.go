@@ -57,6 +57,7 @@ var stockReplyList = []stockReply{
 	{"Email", `[\w-\.]+@(?:[\w-]+\.)+[\w-]{2,4}`},
 	{"Domain", `(?:[\w-]+\.)+[\w-]{2,4}`},
 	{"OTP", `\d{6}`},
+	{"Number", `\d+`},
 	//	{ "IPaddr", `[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}` }
 	{"IPaddr", `(?:(?:0|1[0-9]{0,2}|2[0-9]?|2[0-4][0-9]|25[0-5]|[3-9][0-9]?)\.){3}(?:0|1[0-9]{0,2}|2[0-9]?|2[0-4][0-9]|25[0-5]|[3-9][0-9]?)`},
 	{"SimpleString", `[-\w .,_'"?!]+`},
@@ -84,12 +85,16 @@ func init() {
 //	MatcherNotFound - the regexId didn't correspond to a valid regex
 //	TimeoutExpired - the user didn't respond within the timeout window
 //
+// If the plugin's Context() is cancelled while waiting, PromptForReply
+// returns Interrupted right away.
+//
 // Plugin authors can define regex's for regexId's in the plugin's JSON config,
 // with the restriction that the regexId must start with a lowercase letter.
 // A pre-definied regex from the following list can also be used:
 // 	Email
 //	Domain - an alpha-numeric domain name
 //	OTP - a 6-digit one-time password code
+//	Number - a whole number, e.g. for choosing from a numbered list
 //	IPAddr
 //	SimpleString - Characters commonly found in most english sentences, doesn't
 //    include special characters like @, {, etc.
@@ -146,17 +151,30 @@ func (r *Robot) PromptUserChannelForReply(regexID string, user string, channel s
 	return rep, ret
 }
 
+// interruptPlugin cancels the plugin's Context() when the user interrupts
+// a prompt
+func (r *Robot) interruptPlugin() {
+	if r.interrupt != nil {
+		r.interrupt()
+	}
+}
+
 // promptInternal can return 'RetryPrompt'
 func (r *Robot) promptInternal(regexID string, user string, channel string, prompt string) (string, RetVal) {
 	matcher := replyMatcher{
 		user:    user,
 		channel: channel,
 	}
+	if r.Context().Err() != nil {
+		return "", Interrupted
+	}
 	var rep replyWaiter
-	plugin := currentPlugins.getPluginByID(r.pluginID)
+	// prompts from the robot itself (e.g. disambiguation) only use stock replies
+	pluginName := "(robot)"
 	if stockRepliesRe.MatchString(regexID) {
 		rep.re = stockReplies[regexID]
-	} else {
+	} else if plugin := currentPlugins.getPluginByID(r.pluginID); plugin != nil {
+		pluginName = plugin.name
 		for _, matcher := range plugin.ReplyMatchers {
 			if matcher.Label == regexID {
 				rep.re = matcher.re
@@ -167,7 +185,7 @@ func (r *Robot) promptInternal(regexID string, user string, channel string, prom
 		}
 	}
 	if rep.re == nil {
-		r.Log(Error, fmt.Sprintf("Unable to resolve a reply matcher for plugin %s, regexID %s", plugin.name, regexID))
+		r.Log(Error, fmt.Sprintf("Unable to resolve a reply matcher for plugin %s, regexID %s", pluginName, regexID))
 		return "", MatcherNotFound
 	}
 	rep.replyChannel = make(chan reply)
@@ -224,9 +242,39 @@ func (r *Robot) promptInternal(regexID string, user string, channel string, prom
 		// expired.
 		replies.Unlock()
 		replied = <-rep.replyChannel
+	case <-r.Context().Done():
+		Log(Debug, fmt.Sprintf("Context cancelled waiting for a reply to regex \"%s\" in channel: %s", regexID, r.Channel))
+		replies.Lock()
+		waitlist, found := replies.m[matcher]
+		if found {
+			for i, waiter := range waitlist {
+				if waiter.replyChannel != rep.replyChannel {
+					continue
+				}
+				if i == 0 {
+					// we were the primary waiter; let the others know to retry
+					delete(replies.m, matcher)
+					replies.Unlock()
+					for _, other := range waitlist[1:] {
+						other.replyChannel <- reply{false, retryPrompt, ""}
+					}
+				} else {
+					remaining := make([]replyWaiter, 0, len(waitlist)-1)
+					remaining = append(remaining, waitlist[:i]...)
+					replies.m[matcher] = append(remaining, waitlist[i+1:]...)
+					replies.Unlock()
+				}
+				return "", Interrupted
+			}
+		}
+		// race: a reply is already on it's way; read it as if the context
+		// hadn't been cancelled.
+		replies.Unlock()
+		replied = <-rep.replyChannel
 	case replied = <-rep.replyChannel:
 	}
 	if replied.disposition == replyInterrupted {
+		r.interruptPlugin()
 		return "", Interrupted
 	}
 	if replied.disposition == retryPrompt {
@@ -238,6 +286,7 @@ func (r *Robot) promptInternal(regexID string, user string, channel string, prom
 			return "", UseDefaultValue
 		}
 		if replied.rep == "-" {
+			r.interruptPlugin()
 			return "", Interrupted
 		}
 		return "", ReplyNotMatched
@@ -1,6 +1,7 @@
 package bot
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"time"
@@ -19,10 +20,15 @@ const (
 
 // Robot is passed to the plugin to enable convenience functions Say and Reply
 type Robot struct {
-	User     string        // The user who sent the message; this can be modified for replying to an arbitrary user
-	Channel  string        // The channel where the message was received, or "" for a direct message. This can be modified to send a message to an arbitrary channel.
-	Format   MessageFormat // The outgoing message format, one of Fixed or Variable
-	pluginID string        // Pass the ID in for later identificaton of the plugin
+	User        string             // The user who sent the message; this can be modified for replying to an arbitrary user
+	Channel     string             // The channel where the message was received, or "" for a direct message. This can be modified to send a message to an arbitrary channel.
+	Format      MessageFormat      // The outgoing message format, one of Fixed or Variable
+	pluginID    string             // Pass the ID in for later identificaton of the plugin
+	ctx         context.Context    // Cancelled when the plugin should stop what it's doing, see Context()
+	interrupt   context.CancelFunc // Cancels ctx when the user interrupts the plugin
+	args        map[string]string  // Named arguments for the command, see Args()
+	annotations map[string]string  // Annotations added by middleware, see Annotations()
+	typed       string             // The command as the user typed it, before middleware; for the history
 }
 
 /* robot.go defines some convenience functions on struct Robot to
@@ -33,14 +39,7 @@ type Robot struct {
 // some which require admin. Otherwise the plugin should just configure
 // RequireAdmin: true
 func (r *Robot) CheckAdmin() bool {
-	robot.RLock()
-	defer robot.RUnlock()
-	for _, adminUser := range robot.adminUsers {
-		if r.User == adminUser {
-			return true
-		}
-	}
-	return false
+	return isAdmin(r.CanonicalUser())
 }
 
 // Elevate lets a plugin request elevation on the fly. When immediate = true,
@@ -59,6 +58,19 @@ func (r *Robot) Elevate(immediate bool) bool {
 	return false
 }
 
+// Context returns a context that is cancelled when the plugin should stop
+// what it's doing: the user interrupted a prompt (by issuing a new command or
+// replying '-'), an administrator canceled the job, the plugin's Timeout
+// expired, or the robot is shutting down. Long-running Go plugins should
+// check Context().Done() and return early when it's closed. PromptForReply
+// and Pause return early when the context is cancelled.
+func (r *Robot) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
 // Fixed is a convenience function for sending a message with fixed width
 // font. e.g. r.Reply(xxx) replies in variable width font, but
 // r.Fixed().Reply(xxx) replies in a fixed-width font.
@@ -77,9 +89,13 @@ func (r *Robot) Direct() *Robot {
 }
 
 // Pause is a convenience function to pause some fractional number of seconds.
+// It returns early if the plugin's Context() is cancelled.
 func (r *Robot) Pause(s float64) {
 	ms := time.Duration(s * float64(1000))
-	time.Sleep(ms * time.Millisecond)
+	select {
+	case <-time.After(ms * time.Millisecond):
+	case <-r.Context().Done():
+	}
 }
 
 // RandomString is a convenience function for returning a random string
@@ -126,10 +142,11 @@ func (r *Robot) GetBotAttribute(a string) *AttrRet {
 // - The string Attribute of a user, or "" if unknown/error
 // - A RetVal which is one of Ok, UserNotFound, AttributeNotFound
 // Current attributes:
-// name(handle), fullName, email, firstName, lastName, phone, internalID
-// TODO: supplement data with gopherbot.json user's table
+// name(handle), fullName, email, firstName, lastName, phone, internalID,
+// plus timezone, employeeID and any custom attributes from the UserRoster
+// in gopherbot.yaml
 func (r *Robot) GetUserAttribute(u, a string) *AttrRet {
-	attr, ret := robot.GetProtocolUserAttribute(u, a)
+	attr, ret := getUserAttribute(u, a)
 	return &AttrRet{attr, ret}
 }
 
@@ -137,10 +154,11 @@ func (r *Robot) GetUserAttribute(u, a string) *AttrRet {
 // - The string Attribute of the sender, or "" if unknown/error
 // - A RetVal which is one of Ok, UserNotFound, AttributeNotFound
 // Current attributes:
-// name(handle), fullName, email, firstName, lastName, phone, internalID
-// TODO: supplement data with gopherbot.json user's table
+// name(handle), fullName, email, firstName, lastName, phone, internalID,
+// plus timezone, employeeID and any custom attributes from the UserRoster
+// in gopherbot.yaml
 func (r *Robot) GetSenderAttribute(a string) *AttrRet {
-	attr, ret := robot.GetProtocolUserAttribute(r.User, a)
+	attr, ret := getUserAttribute(r.User, a)
 	return &AttrRet{attr, ret}
 }
 
@@ -0,0 +1,87 @@
+package bot
+
+/* roster.go - the UserRoster from gopherbot.yaml, which supplements (or
+   overrides) user attributes from the chat protocol. */
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values for UserAttributePrecedence
+const (
+	protocolFirst = "protocol" // use the protocol's value when it has one (default)
+	rosterFirst   = "roster"   // use the roster's value when it has one
+)
+
+// UserInfo holds attributes for a user in the UserRoster
+type UserInfo struct {
+	Email       string
+	FullName    string
+	FirstName   string
+	LastName    string
+	Phone       string
+	Timezone    string
+	EmployeeID  string
+	Attributes  map[string]string // Any other attributes, e.g. "office"
+	ProtocolIDs map[string]string // Internal user IDs by protocol, e.g. slack: U0123ABCD; see identity.go
+}
+
+// attribute returns a named attribute, or "" if the roster doesn't have it
+func (u UserInfo) attribute(a string) string {
+	switch strings.ToLower(a) {
+	case "email":
+		return u.Email
+	case "fullname", "realname":
+		return u.FullName
+	case "firstname":
+		return u.FirstName
+	case "lastname":
+		return u.LastName
+	case "phone":
+		return u.Phone
+	case "timezone", "tz":
+		return u.Timezone
+	case "employeeid":
+		return u.EmployeeID
+	}
+	return u.Attributes[a]
+}
+
+// validPrecedence checks a UserAttributePrecedence value
+func validPrecedence(p string) error {
+	switch p {
+	case "", protocolFirst, rosterFirst:
+		return nil
+	}
+	return fmt.Errorf("UserAttributePrecedence must be \"%s\" or \"%s\", not \"%s\"", protocolFirst, rosterFirst, p)
+}
+
+// getUserAttribute merges the protocol's user attributes with the
+// UserRoster, according to UserAttributePrecedence. The roster is indexed
+// by the user's canonical name, which may differ from their chat handle.
+func getUserAttribute(user, a string) (string, RetVal) {
+	canonical := canonicalUser(user)
+	robot.RLock()
+	info, inRoster := robot.userRoster[canonical]
+	precedence := robot.attrPrecedence
+	robot.RUnlock()
+	rosterAttr := ""
+	if inRoster {
+		rosterAttr = info.attribute(a)
+	}
+	if precedence == rosterFirst && rosterAttr != "" {
+		return rosterAttr, Ok
+	}
+	attr, ret := robot.GetProtocolUserAttribute(user, a)
+	if ret == Ok && attr != "" {
+		return attr, Ok
+	}
+	if rosterAttr != "" {
+		return rosterAttr, Ok
+	}
+	if ret == UserNotFound && inRoster {
+		ret = AttributeNotFound
+	}
+	return attr, ret
+}
@@ -0,0 +1,19 @@
+package bot
+
+/* sandbox.go - optional restrictions on an external plugin's process. The
+   Sandbox is configured with the plugin's entry in ExternalPlugins, rather
+   than the plugin's own configuration, so a plugin can't loosen it; it
+   applies when the robot runs the plugin to get it's default configuration,
+   too. Sandboxing is only implemented on Linux, see sandbox_linux.go. */
+
+// Sandbox restricts the process of an external plugin
+type Sandbox struct {
+	User          string // user name or uid to run the plugin as; requires the robot to run as root
+	Group         string // group name or gid to run the plugin as; defaults to User's primary group
+	CPUSeconds    int    // limit on CPU time, in seconds
+	MemoryMB      int    // limit on virtual memory, in megabytes
+	OpenFiles     int    // limit on open files
+	PrivateDir    bool   // run in a new, empty directory, also used for HOME and TMPDIR, removed when the plugin exits
+	NoNetwork     bool   // run in a new network namespace with no network - not even the robot's http port
+	PrivateMounts bool   // run in a new mount namespace, so the plugin's mounts aren't visible to the rest of the system
+}
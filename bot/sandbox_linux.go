@@ -0,0 +1,189 @@
+// +build linux
+
+package bot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment variables a sandboxed plugin gets from the robot's environment,
+// besides the GOPHER_* variables it needs for the plugin API
+var sandboxEnv = map[string]bool{
+	"PATH":   true,
+	"LANG":   true,
+	"HOME":   true,
+	"TMPDIR": true,
+}
+
+// sandboxEnviron returns the allowed variables from env, leaving out HOME
+// and TMPDIR for plugins with a PrivateDir.
+func sandboxEnviron(env []string, privateDir bool) []string {
+	allowed := make([]string, 0, len(env))
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if privateDir && (name == "HOME" || name == "TMPDIR") {
+			continue
+		}
+		if sandboxEnv[name] || strings.HasPrefix(name, "GOPHER_") {
+			allowed = append(allowed, kv)
+		}
+	}
+	return allowed
+}
+
+// validate checks a Sandbox when the configuration is loaded
+func (s *Sandbox) validate() error {
+	if s.CPUSeconds < 0 || s.MemoryMB < 0 || s.OpenFiles < 0 {
+		return fmt.Errorf("CPUSeconds, MemoryMB and OpenFiles can't be negative")
+	}
+	if s.Group != "" && s.User == "" {
+		return fmt.Errorf("Group requires a User")
+	}
+	if s.User != "" {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("running plugins as another User requires the robot to run as root")
+		}
+		if _, err := s.credential(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUser finds a user by name or uid
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, nerr := strconv.Atoi(name); nerr == nil {
+		return user.LookupId(name)
+	}
+	return nil, err
+}
+
+// lookupGroup finds a group by name or gid
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if err == nil {
+		return g, nil
+	}
+	if _, nerr := strconv.Atoi(name); nerr == nil {
+		return user.LookupGroupId(name)
+	}
+	return nil, err
+}
+
+// credential looks up the User and Group the plugin runs as, including the
+// user's supplementary groups.
+func (s *Sandbox) credential() (*syscall.Credential, error) {
+	u, err := lookupUser(s.User)
+	if err != nil {
+		return nil, fmt.Errorf("looking up sandbox User \"%s\": %v", s.User, err)
+	}
+	uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+	if s.Group != "" {
+		g, err := lookupGroup(s.Group)
+		if err != nil {
+			return nil, fmt.Errorf("looking up sandbox Group \"%s\": %v", s.Group, err)
+		}
+		gid, _ = strconv.ParseUint(g.Gid, 10, 32)
+	}
+	groups := []uint32{}
+	if gids, err := u.GroupIds(); err == nil {
+		for _, g := range gids {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				groups = append(groups, uint32(id))
+			}
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
+// ulimits returns shell commands setting the resource limits; both the soft
+// and hard limits are set, so the plugin can't raise them.
+func (s *Sandbox) ulimits() string {
+	var limits string
+	if s.CPUSeconds > 0 {
+		limits += fmt.Sprintf("ulimit -t %d && ", s.CPUSeconds)
+	}
+	if s.MemoryMB > 0 {
+		limits += fmt.Sprintf("ulimit -v %d && ", s.MemoryMB*1024)
+	}
+	if s.OpenFiles > 0 {
+		limits += fmt.Sprintf("ulimit -n %d && ", s.OpenFiles)
+	}
+	return limits
+}
+
+// sandboxCommand applies the Sandbox to an external plugin's command before
+// it's started; the plugin only gets the environment variables allowed by
+// sandboxEnv. The returned cleanup function removes the private
+// directory, and should be called once the plugin has exited.
+func sandboxCommand(cmd *exec.Cmd, plugin string, s *Sandbox) (cleanup func(), err error) {
+	cleanup = func() {}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = sandboxEnviron(env, s.PrivateDir)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	if s.User != "" {
+		if attr.Credential, err = s.credential(); err != nil {
+			return
+		}
+	}
+	if s.NoNetwork {
+		// this includes the robot's localhost http port, so the plugin
+		// can't call any robot methods
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if s.PrivateMounts {
+		// Go makes the mounts private, so they don't propagate back
+		attr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	// Without root, creating namespaces needs a user namespace; the robot's
+	// user is mapped to itself.
+	if (s.NoNetwork || s.PrivateMounts) && os.Geteuid() != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+	}
+	if limits := s.ulimits(); limits != "" {
+		// There's no way to set rlimits between fork and exec in Go, so a
+		// shell sets them and execs the plugin, which is "$0".
+		cmd.Args = append([]string{"/bin/sh", "-c", limits + `exec "$0" "$@"`}, cmd.Args...)
+		cmd.Path = "/bin/sh"
+	}
+	if s.PrivateDir {
+		var dir string
+		if dir, err = ioutil.TempDir("", "gopherbot-"+plugin+"-"); err != nil {
+			return
+		}
+		cleanup = func() {
+			if err := os.RemoveAll(dir); err != nil {
+				Log(Error, fmt.Sprintf("Removing private directory for plugin \"%s\": %v", plugin, err))
+			}
+		}
+		if attr.Credential != nil {
+			if err = os.Chown(dir, int(attr.Credential.Uid), int(attr.Credential.Gid)); err != nil {
+				cleanup()
+				return func() {}, err
+			}
+		}
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, "HOME="+dir, "TMPDIR="+dir)
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestSandboxEnvironment(t *testing.T) {
+	cmd := exec.Command("/bin/true")
+	cmd.Env = []string{"PATH=/bin", "LANG=C", "HOME=/root", "AWS_SECRET_ACCESS_KEY=secret", "GOPHER_USER=alice", "GOPHER_HTTP_POST=http://127.0.0.1:8880"}
+	cleanup, err := sandboxCommand(cmd, "test", &Sandbox{PrivateDir: true})
+	if err != nil {
+		t.Fatalf("sandboxCommand: %v", err)
+	}
+	defer cleanup()
+	want := map[string]bool{
+		"PATH=/bin":                              true,
+		"LANG=C":                                 true,
+		"GOPHER_USER=alice":                      true,
+		"GOPHER_HTTP_POST=http://127.0.0.1:8880": true,
+		"HOME=" + cmd.Dir:                        true,
+		"TMPDIR=" + cmd.Dir:                      true,
+	}
+	for _, kv := range cmd.Env {
+		if !want[kv] {
+			t.Errorf("Sandboxed plugin got %s", kv)
+		}
+		delete(want, kv)
+	}
+	for kv := range want {
+		t.Errorf("Sandboxed plugin didn't get %s", kv)
+	}
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package bot
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+var errSandboxUnsupported = fmt.Errorf("sandboxing external plugins is only supported on Linux")
+
+// validate always fails; there's no sandboxing on this platform
+func (s *Sandbox) validate() error {
+	return errSandboxUnsupported
+}
+
+// sandboxCommand always fails; there's no sandboxing on this platform
+func sandboxCommand(cmd *exec.Cmd, plugin string, s *Sandbox) (cleanup func(), err error) {
+	return func() {}, errSandboxUnsupported
+}
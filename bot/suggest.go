@@ -0,0 +1,234 @@
+package bot
+
+/* suggest.go - when the robot is addressed but nothing matches, suggest the
+   closest commands from plugin help before falling back to CatchAll
+   plugins. */
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maximum number of suggestions to offer
+const maxSuggestions = 3
+
+// minimum score for a help line to be suggested; roughly one close word
+const minSuggestScore = 0.7
+
+// common words that shouldn't count towards a match
+var suggestStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "you": true, "can": true,
+	"what": true, "with": true, "please": true, "bot": true,
+}
+
+// matches runs of letters and digits in a regex, ignoring flag groups
+var regexLiteralRe = regexp.MustCompile(`\(\?[a-zA-Z]+[:)]|[\pL\pN]+`)
+
+// a suggestion is a help line and how closely it matched
+type suggestion struct {
+	text  string
+	score float64
+}
+
+// suggestWords splits text into lowercase words of at least three letters,
+// leaving out stop words
+func suggestWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if len([]rune(f)) > 2 && !suggestStopWords[f] {
+			words = append(words, f)
+		}
+	}
+	return words
+}
+
+// regexLiterals returns the literal words in a matcher regex, e.g. the
+// alternatives in '(?i:hosts?|lookup|dig)'.
+func regexLiterals(re string) []string {
+	words := make([]string, 0)
+	for _, lit := range regexLiteralRe.FindAllString(re, -1) {
+		if strings.HasPrefix(lit, "(?") {
+			continue
+		}
+		lit = strings.ToLower(lit)
+		// skip escapes like \w and \d
+		if len([]rune(lit)) > 2 {
+			words = append(words, lit)
+		}
+	}
+	return words
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// wordSimilarity scores how closely a word from the user matches a term,
+// from 0 (not at all) to 1 (exactly). Short words need to be closer.
+func wordSimilarity(word, term string) float64 {
+	if word == term {
+		return 1
+	}
+	lw, lt := len([]rune(word)), len([]rune(term))
+	if lw > 2 && strings.HasPrefix(term, word) {
+		return 0.9
+	}
+	max := lw
+	if lt > max {
+		max = lt
+	}
+	allowed := 1
+	if max > 5 {
+		allowed = 2
+	}
+	d := editDistance(word, term)
+	if d > allowed {
+		return 0
+	}
+	return 1 - float64(d)/float64(max)
+}
+
+// scoreTerms adds up the best similarity for each word the user typed
+func scoreTerms(words []string, terms map[string]bool) float64 {
+	var score float64
+	for _, word := range words {
+		var best float64
+		for term := range terms {
+			if s := wordSimilarity(word, term); s > best {
+				best = s
+			}
+		}
+		score += best
+	}
+	return score
+}
+
+// unmatchedCommand handles a command that didn't match any plugin: the
+// closest commands are suggested if there are any, otherwise the CatchAll
+// plugins are called, or the user is pointed at help when there are none.
+func unmatchedCommand(bot *Robot, plugins, catchAlls []*Plugin, messagetext string) {
+	defer checkPanic(bot, messagetext)
+	if suggestCommands(bot, plugins, messagetext) {
+		return
+	}
+	if len(catchAlls) > 0 {
+		Log(Debug, fmt.Sprintf("No suggestions for unmatched command, calling catchalls: %s", messagetext))
+		for _, plugin := range catchAlls {
+			go callPlugin(bot, plugin, true, true, "catchall", messagetext)
+		}
+		return
+	}
+	robot.RLock()
+	name := robot.name
+	robot.RUnlock()
+	bot.Reply(fmt.Sprintf("Sorry, I don't know how to do that - try '%s, help' for a list of commands", name))
+}
+
+// suggestCommands compares an unmatched command with the help keywords and
+// text, and the command regexes, of every plugin available to the user in the
+// channel, and replies with the closest help lines. It returns false if
+// nothing was close enough to suggest.
+func suggestCommands(bot *Robot, plugins []*Plugin, messagetext string) bool {
+	words := suggestWords(messagetext)
+	if len(words) == 0 {
+		return false
+	}
+	robot.RLock()
+	name := robot.name
+	robot.RUnlock()
+	var suggestions []suggestion
+	seen := make(map[string]bool)
+	for _, plugin := range plugins {
+		if !pluginAvailable(bot.User, bot.Channel, plugin) {
+			continue
+		}
+		matcherTerms := make([][]string, 0, len(plugin.CommandMatchers))
+		for _, matcher := range plugin.CommandMatchers {
+			matcherTerms = append(matcherTerms, regexLiterals(matcher.Regex))
+		}
+		for _, phelp := range plugin.Help {
+			for _, helptext := range phelp.Helptext {
+				text := strings.Replace(helptext, "(bot)", name, -1)
+				if seen[text] {
+					continue
+				}
+				terms := make(map[string]bool)
+				for _, keyword := range phelp.Keywords {
+					for _, w := range suggestWords(keyword) {
+						terms[w] = true
+					}
+				}
+				for _, w := range suggestWords(helptext) {
+					terms[w] = true
+				}
+				// the regex of a command described by this line may have
+				// synonyms that aren't in the help text
+				for _, literals := range matcherTerms {
+					related := false
+					for _, lit := range literals {
+						if terms[lit] {
+							related = true
+							break
+						}
+					}
+					if related {
+						for _, lit := range literals {
+							terms[lit] = true
+						}
+					}
+				}
+				score := scoreTerms(words, terms)
+				if score >= minSuggestScore {
+					seen[text] = true
+					suggestions = append(suggestions, suggestion{text, score})
+				}
+			}
+		}
+	}
+	if len(suggestions) == 0 {
+		Log(Debug, fmt.Sprintf("No suggestions found for unmatched command \"%s\"", messagetext))
+		return false
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].score > suggestions[j].score })
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	lines := make([]string, 0, len(suggestions)+1)
+	lines = append(lines, "Sorry, I didn't understand that - did you mean:")
+	for _, s := range suggestions {
+		lines = append(lines, s.text)
+	}
+	Log(Debug, fmt.Sprintf("Offering %d suggestion(s) for unmatched command \"%s\"", len(suggestions), messagetext))
+	bot.Reply(strings.Join(lines, "\n"))
+	return true
+}
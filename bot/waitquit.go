@@ -19,9 +19,12 @@ func init() {
 		pluginsRunning.Lock()
 		pluginsRunning.shuttingDown = true
 		pluginsRunning.Unlock()
+		interruptJobs()
 		Log(Info, fmt.Sprintf("Received signal: %s, shutting down gracefully", sig))
 		// Wait for all plugins to stop running
 		pluginsRunning.Wait()
+		// Let plugins flush state before the brain goes away
+		shutdownPlugins()
 		// Stop the brain after it finishes any current task
 		brainQuit()
 		Log(Info, fmt.Sprintf("Exiting on signal: %s", sig))
@@ -61,8 +61,11 @@ loop:
 	} else {
 		pluginsRunning.Unlock()
 	}
+	interruptJobs()
 	// Wait for all plugins to stop running
 	pluginsRunning.Wait()
+	// Let plugins flush state before the brain goes away
+	shutdownPlugins()
 	// Stop the brain after it finishes any current task
 	brainQuit()
 	Log(Info, "Exiting on administrator command")
@@ -0,0 +1,182 @@
+package bot
+
+/* workers.go - limits on how many plugins can run at once, globally and
+   per-plugin. Jobs over the limit wait in a FIFO queue. */
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default reply when a job has to wait; (count) is replaced with the number
+// of jobs ahead of it
+const defaultQueuedReply = "I'm pretty busy right now - your request is queued behind (count) other job(s)"
+
+// a jobQueue tracks the running jobs for a given limit, and the jobs waiting
+// for a free slot
+type jobQueue struct {
+	running int
+	waiting []chan struct{}
+}
+
+var jobQueues = struct {
+	global  jobQueue
+	plugins map[string]*jobQueue
+	sync.Mutex
+}{
+	jobQueue{},
+	make(map[string]*jobQueue),
+	sync.Mutex{},
+}
+
+// enter takes a slot if one is free, or returns a channel that will be closed
+// when the job gets a slot, along with the number of jobs ahead of it.
+// Called with jobQueues locked; limit <= 0 means unlimited.
+func (q *jobQueue) enter(limit int) (wait chan struct{}, ahead int) {
+	if limit <= 0 || (q.running < limit && len(q.waiting) == 0) {
+		q.running++
+		return nil, 0
+	}
+	ahead = q.running + len(q.waiting)
+	wait = make(chan struct{})
+	q.waiting = append(q.waiting, wait)
+	return wait, ahead
+}
+
+// leave frees a slot and hands free slots to waiting jobs in order. Called
+// with jobQueues locked.
+func (q *jobQueue) leave(limit int) {
+	q.running--
+	for len(q.waiting) > 0 && (limit <= 0 || q.running < limit) {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		close(next)
+	}
+}
+
+// wait waits for a queued job to get a slot, returning false if the job's
+// context is done first, in which case it's taken out of the queue.
+func (q *jobQueue) wait(ctx context.Context, wait chan struct{}, limit func() int) bool {
+	select {
+	case <-wait:
+		return true
+	case <-ctx.Done():
+	}
+	jobQueues.Lock()
+	defer jobQueues.Unlock()
+	for i, w := range q.waiting {
+		if w == wait {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return false
+		}
+	}
+	// the job got a slot just as it was canceled
+	q.leave(limit())
+	return false
+}
+
+// pluginLimit returns the maximum number of concurrent jobs for a plugin
+func pluginLimit(plugin *Plugin) int {
+	if plugin.SingleInstance {
+		return 1
+	}
+	return plugin.MaxConcurrent
+}
+
+// globalLimit returns the configured MaxConcurrentPlugins
+func globalLimit() int {
+	robot.RLock()
+	limit := robot.maxConcurrent
+	robot.RUnlock()
+	return limit
+}
+
+// acquireJobSlot waits for a free slot for the plugin, first in the
+// plugin's own queue, then in the global queue. It returns a function for
+// releasing the slot, or ok=false if the job shouldn't run - including when
+// the job's context is canceled while it's queued. The user is only told
+// about queueing and refusals for interactive jobs; jobs from events
+// weren't requested by the user, so those are just logged.
+func acquireJobSlot(ctx context.Context, bot *Robot, plugin *Plugin, interactive bool, command string) (release func(), ok bool) {
+	plimit := pluginLimit(plugin)
+	plimitf := func() int { return pluginLimit(plugin) }
+	jobQueues.Lock()
+	pq, exists := jobQueues.plugins[plugin.name]
+	if !exists {
+		pq = &jobQueue{}
+		jobQueues.plugins[plugin.name] = pq
+	}
+	if plugin.SingleInstance && pq.running > 0 {
+		jobQueues.Unlock()
+		Log(Debug, fmt.Sprintf("Not running single-instance plugin \"%s\" command \"%s\" for user \"%s\", already running", plugin.name, command, bot.User))
+		if interactive {
+			bot.Reply(fmt.Sprintf("Sorry, \"%s\" is already running and only one can run at a time; try again when it's finished", plugin.name))
+		}
+		return nil, false
+	}
+	queued := false
+	pwait, ahead := pq.enter(plimit)
+	jobQueues.Unlock()
+	if pwait != nil {
+		queued = true
+		if interactive {
+			sendQueuedReply(bot, ahead)
+		}
+		Log(Debug, fmt.Sprintf("Plugin \"%s\" command \"%s\" queued behind %d other jobs for plugin", plugin.name, command, ahead))
+		if !pq.wait(ctx, pwait, plimitf) {
+			return nil, false
+		}
+	}
+	glimit := globalLimit()
+	jobQueues.Lock()
+	gwait, ahead := jobQueues.global.enter(glimit)
+	jobQueues.Unlock()
+	if gwait != nil {
+		if !queued && interactive {
+			sendQueuedReply(bot, ahead)
+		}
+		queued = true
+		Log(Debug, fmt.Sprintf("Plugin \"%s\" command \"%s\" queued behind %d other jobs, MaxConcurrentPlugins reached", plugin.name, command, ahead))
+		if !jobQueues.global.wait(ctx, gwait, globalLimit) {
+			jobQueues.Lock()
+			pq.leave(plimitf())
+			jobQueues.Unlock()
+			return nil, false
+		}
+	}
+	release = func() {
+		jobQueues.Lock()
+		jobQueues.global.leave(globalLimit())
+		pq.leave(pluginLimit(plugin))
+		jobQueues.Unlock()
+	}
+	if queued {
+		pluginsRunning.Lock()
+		shuttingDown := pluginsRunning.shuttingDown
+		pluginsRunning.Unlock()
+		if shuttingDown {
+			release()
+			Log(Info, fmt.Sprintf("Not running queued plugin \"%s\" command \"%s\" for user \"%s\", shutting down", plugin.name, command, bot.User))
+			if interactive {
+				bot.Reply(fmt.Sprintf("Sorry, I'm shutting down and won't be running your queued \"%s\" command", command))
+			}
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// sendQueuedReply lets the user know their job is waiting
+func sendQueuedReply(bot *Robot, ahead int) {
+	robot.RLock()
+	msg := robot.queuedReply
+	robot.RUnlock()
+	if msg == "" {
+		msg = defaultQueuedReply
+	}
+	bot.Reply(strings.Replace(msg, "(count)", strconv.Itoa(ahead), -1))
+}
@@ -118,8 +118,12 @@ loop:
 			switch ev := msg.Data.(type) {
 			case *slack.HelloEvent:
 				// Ignore hello
-			case *slack.ChannelArchiveEvent, *slack.ChannelCreatedEvent, *slack.ChannelDeletedEvent, *slack.ChannelRenameEvent, *slack.TeamJoinEvent, *slack.GroupJoinedEvent, *slack.UserChangeEvent:
+			case *slack.ChannelArchiveEvent, *slack.ChannelUnarchiveEvent, *slack.ChannelCreatedEvent, *slack.ChannelDeletedEvent, *slack.ChannelRenameEvent, *slack.TeamJoinEvent, *slack.GroupJoinedEvent, *slack.ChannelJoinedEvent, *slack.ChannelLeftEvent, *slack.UserChangeEvent:
+				// look up names before updating, so deleted channels still
+				// have a name
+				event := sc.translateEvent(msg.Data)
 				sc.updateMaps()
+				sc.reportEvent(event)
 
 			case *slack.MessageEvent:
 				// Message processing is done concurrently
@@ -127,6 +131,7 @@ loop:
 
 			case *slack.PresenceChangeEvent:
 				sc.Log(bot.Debug, fmt.Sprintf("Presence Change: %v", ev))
+				sc.reportEvent(sc.translateEvent(ev))
 
 			case *slack.LatencyReport:
 				sc.Log(bot.Debug, fmt.Sprintf("Current latency: %v", ev.Value))
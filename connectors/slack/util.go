@@ -322,3 +322,57 @@ func (s *slackConnector) updateMaps() {
 	s.Unlock()
 	s.Log(bot.Info, "User/Group/Channel maps updated")
 }
+
+// translateEvent converts a slack event into a bot.Event, or returns nil
+// for events the robot doesn't report. For events that remove channels, this
+// should be called before updating maps.
+func (s *slackConnector) translateEvent(data interface{}) *bot.Event {
+	ev := &bot.Event{Data: make(map[string]string)}
+	switch e := data.(type) {
+	case *slack.TeamJoinEvent:
+		ev.Type, ev.User = bot.EventUserJoined, e.User.Name
+		ev.Data["realname"] = e.User.RealName
+	case *slack.UserChangeEvent:
+		ev.Type, ev.User = bot.EventUserChanged, e.User.Name
+		ev.Data["realname"] = e.User.RealName
+	case *slack.PresenceChangeEvent:
+		ev.Type = bot.EventPresenceChanged
+		ev.User, _ = s.userName(e.User)
+		ev.Data["presence"] = e.Presence
+	case *slack.ChannelCreatedEvent:
+		ev.Type, ev.Channel = bot.EventChannelCreated, e.Channel.Name
+		ev.User, _ = s.userName(e.Channel.Creator)
+	case *slack.ChannelDeletedEvent:
+		ev.Type = bot.EventChannelDeleted
+		ev.Channel, _ = s.channelName(e.Channel)
+	case *slack.ChannelArchiveEvent:
+		ev.Type = bot.EventChannelArchived
+		ev.Channel, _ = s.channelName(e.Channel)
+		ev.User, _ = s.userName(e.User)
+	case *slack.ChannelUnarchiveEvent:
+		ev.Type = bot.EventChannelUnarchived
+		ev.Channel, _ = s.channelName(e.Channel)
+		ev.User, _ = s.userName(e.User)
+	case *slack.ChannelRenameEvent:
+		ev.Type, ev.Channel = bot.EventChannelRenamed, e.Channel.Name
+		ev.Data["oldname"], _ = s.channelName(e.Channel.ID)
+	case *slack.ChannelJoinedEvent:
+		ev.Type, ev.Channel = bot.EventRobotJoined, e.Channel.Name
+	case *slack.GroupJoinedEvent:
+		ev.Type, ev.Channel = bot.EventRobotJoined, e.Channel.Name
+	case *slack.ChannelLeftEvent:
+		ev.Type = bot.EventRobotLeft
+		ev.Channel, _ = s.channelName(e.Channel)
+	default:
+		return nil
+	}
+	return ev
+}
+
+// reportEvent passes a translated event on to the robot
+func (s *slackConnector) reportEvent(ev *bot.Event) {
+	if ev == nil {
+		return
+	}
+	s.IncomingEvent(*ev)
+}
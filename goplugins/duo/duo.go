@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	duoapi "github.com/duosecurity/duo_api_golang"
@@ -12,22 +11,11 @@ import (
 	"github.com/uva-its/gopherbot/bot"
 )
 
-var timeoutLock sync.RWMutex
-var lastElevate = make(map[string]time.Time)
 var auth *authapi.AuthApi
 
-type timeoutType int
-
-const (
-	idle timeoutType = iota
-	absolute
-)
-
 type config struct {
 	TimeoutSeconds int
-	tf64           float64
 	TimeoutType    string // TimeoutType - one of idle, absolute
-	tt             timeoutType
 	DuoIKey        string
 	DuoSKey        string
 	DuoHost        string
@@ -45,6 +33,34 @@ var cfg config
 const memoryKey = "duoOpts"
 const datumName = "duoOpts"
 
+// userDefault returns the user's configured device and method. Defaults
+// saved under the user's chat handle, before they were keyed by canonical
+// identity, are moved to the canonical key.
+func userDefault(r *bot.Robot) (duoDefault, bool) {
+	var duoDefs duoDefMap
+	user := r.CanonicalUser()
+	tok, exists, ret := r.CheckoutDatum(datumName, &duoDefs, true)
+	if ret != bot.Ok || !exists {
+		r.CheckinDatum(datumName, tok)
+		return duoDefault{}, false
+	}
+	if def, ok := duoDefs[user]; ok {
+		r.CheckinDatum(datumName, tok)
+		return def, true
+	}
+	def, ok := duoDefs[r.User]
+	if !ok || user == r.User {
+		r.CheckinDatum(datumName, tok)
+		return def, ok
+	}
+	duoDefs[user] = def
+	delete(duoDefs, r.User)
+	if ret = r.UpdateDatum(datumName, tok, duoDefs); ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("Couldn't move duo defaults for \"%s\" to canonical identity \"%s\": %s", r.User, user, ret))
+	}
+	return def, true
+}
+
 func authduo(r *bot.Robot, immediate bool, user string, res *authapi.PreauthResult) (retval bot.PlugRetVal) {
 	dm := ""
 	if r.Channel != "" {
@@ -62,17 +78,11 @@ func authduo(r *bot.Robot, immediate bool, user string, res *authapi.PreauthResu
 	var factor, memtype string
 	var err error
 
-	var duoDefs duoDefMap
-
-	_, exists, ret := r.CheckoutDatum(datumName, &duoDefs, false)
-	if ret == bot.Ok && exists {
-		duoDefConfig, ok := duoDefs[r.User]
-		if ok {
-			devnum = duoDefConfig.device
-			method = duoDefConfig.method
-			remembered = true
-			memtype = "configured"
-		}
+	if duoDefConfig, ok := userDefault(r); ok {
+		devnum = duoDefConfig.device
+		method = duoDefConfig.method
+		remembered = true
+		memtype = "configured"
 	}
 
 	if !remembered {
@@ -358,7 +368,10 @@ func configure(r *bot.Robot, user string, res *authapi.PreauthResult) (retval bo
 		if !exists {
 			duoDefs = make(map[string]duoDefault)
 		}
-		duoDefs[r.User] = duoDefConfig
+		duoDefs[r.CanonicalUser()] = duoDefConfig
+		if r.User != r.CanonicalUser() {
+			delete(duoDefs, r.User)
+		}
 		r.UpdateDatum(datumName, tok, duoDefs)
 		r.Reply("Your duo default configuration has been set")
 		return bot.Normal
@@ -380,10 +393,6 @@ func duocommands(r *bot.Robot, command string, args ...string) (retval bot.PlugR
 	}
 	cfg := &config{}
 	r.GetPluginConfig(&cfg)
-	if cfg.TimeoutType == "absolute" {
-		cfg.tt = absolute
-	}
-	cfg.tf64 = float64(cfg.TimeoutSeconds)
 	duo := duoapi.NewDuoApi(cfg.DuoIKey, cfg.DuoSKey, cfg.DuoHost, "Gopherbot", duoapi.SetTimeout(10*time.Second))
 	auth = authapi.NewAuthApi(*duo)
 	var duouser string
@@ -419,36 +428,12 @@ func duocommands(r *bot.Robot, command string, args ...string) (retval bot.PlugR
 		return configure(r, duouser, res)
 	}
 
-	now := time.Now().UTC()
-	ask := false
-	if immediate {
-		retval = authduo(r, immediate, duouser, res)
-	} else {
-		timeoutLock.RLock()
-		le, ok := lastElevate[r.User]
-		timeoutLock.RUnlock()
-		if ok {
-			diff := now.Sub(le)
-			if diff.Seconds() > cfg.tf64 {
-				ask = true
-			} else {
-				retval = bot.Success
-			}
-		} else {
-			ask = true
-		}
-		if ask {
-			retval = authduo(r, immediate, duouser, res)
-		}
+	if !immediate && r.CheckElevationSession(cfg.TimeoutSeconds, cfg.TimeoutType) {
+		return bot.Success
 	}
-	if retval == bot.Success && cfg.tt == idle {
-		timeoutLock.Lock()
-		lastElevate[r.User] = now
-		timeoutLock.Unlock()
-	} else if retval == bot.Success && ask && cfg.tt == absolute {
-		timeoutLock.Lock()
-		lastElevate[r.User] = now
-		timeoutLock.Unlock()
+	retval = authduo(r, immediate, duouser, res)
+	if retval == bot.Success {
+		r.StartElevationSession(cfg.TimeoutSeconds)
 	}
 	return
 }
@@ -0,0 +1,233 @@
+// Package emailotp is an elevator plugin for users without an authenticator
+// app or Duo: it emails the user a short-lived numeric code, using the
+// robot's MailConfig, and prompts for it. Successful elevation starts an
+// elevation session like the other elevators.
+package emailotp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/uva-its/gopherbot/bot"
+)
+
+const (
+	defaultCodeLength  = 6
+	minCodeLength      = 4
+	maxCodeLength      = 10
+	defaultCodeExpiry  = 300
+	defaultMaxAttempts = 3
+)
+
+type config struct {
+	CodeLength     int    // digits in the code, 4-10, default 6
+	CodeExpiry     int    // seconds the emailed code is good for, default 300
+	MaxAttempts    int    // wrong codes allowed before elevation fails, default 3
+	TimeoutSeconds int    // how long elevation lasts; 0 asks every time
+	TimeoutType    string // idle or absolute, see bot.IdleTimeout
+}
+
+// newCode generates a random numeric code with leading zeros
+func newCode(length int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", length, n), nil
+}
+
+// checkConfig fills in defaults, returning an error for invalid values
+func checkConfig(cfg *config) error {
+	if cfg.CodeLength == 0 {
+		cfg.CodeLength = defaultCodeLength
+	}
+	if cfg.CodeLength < minCodeLength || cfg.CodeLength > maxCodeLength {
+		return fmt.Errorf("CodeLength must be between %d and %d, not %d", minCodeLength, maxCodeLength, cfg.CodeLength)
+	}
+	if cfg.CodeExpiry == 0 {
+		cfg.CodeExpiry = defaultCodeExpiry
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.CodeExpiry < 0 || cfg.MaxAttempts < 0 || cfg.TimeoutSeconds < 0 {
+		return fmt.Errorf("CodeExpiry, MaxAttempts and TimeoutSeconds can't be negative")
+	}
+	switch cfg.TimeoutType {
+	case "", bot.IdleTimeout, bot.AbsoluteTimeout:
+	default:
+		return fmt.Errorf("TimeoutType must be \"%s\" or \"%s\", not \"%s\"", bot.IdleTimeout, bot.AbsoluteTimeout, cfg.TimeoutType)
+	}
+	return nil
+}
+
+// otpRobot is the part of *bot.Robot that getcode uses, so tests can supply
+// a fake.
+type otpRobot interface {
+	Email(subject string, messageBody *bytes.Buffer) bot.RetVal
+	Say(msg string) bot.RetVal
+	Reply(msg string) bot.RetVal
+	Log(l bot.LogLevel, v ...interface{})
+	Pause(s float64)
+	user() string
+	inChannel() bool
+	sayDirect(msg string) bot.RetVal
+	promptDirect(regexID, prompt string) (string, bot.RetVal)
+}
+
+// botRobot adapts *bot.Robot to otpRobot
+type botRobot struct {
+	*bot.Robot
+}
+
+func (r botRobot) user() string {
+	return r.User
+}
+
+func (r botRobot) inChannel() bool {
+	return r.Channel != ""
+}
+
+func (r botRobot) sayDirect(msg string) bot.RetVal {
+	return r.Direct().Say(msg)
+}
+
+func (r botRobot) promptDirect(regexID, prompt string) (string, bot.RetVal) {
+	return r.Direct().PromptForReply(regexID, prompt)
+}
+
+// sendCode emails the code to the user
+func sendCode(r otpRobot, code string, expires time.Duration) bot.RetVal {
+	var codeMail bytes.Buffer
+	fmt.Fprintf(&codeMail, "Your one-time code is: %s\n\n", code)
+	fmt.Fprintf(&codeMail, "It's good for %s. If you didn't ask for it, somebody may be using your chat account - let an administrator know.\n", expires)
+	return r.Email("Your one-time elevation code", &codeMail)
+}
+
+// getcode emails a code and prompts for it, allowing MaxAttempts wrong
+// codes before the code expires.
+func getcode(r otpRobot, cfg *config, immediate bool) bot.PlugRetVal {
+	code, err := newCode(cfg.CodeLength)
+	if err != nil {
+		r.Log(bot.Error, fmt.Sprintf("Generating one-time code for user %s: %v", r.user(), err))
+		return bot.MechanismFail
+	}
+	expiry := time.Duration(cfg.CodeExpiry) * time.Second
+	expires := time.Now().Add(expiry)
+	switch ret := sendCode(r, code, expiry); ret {
+	case bot.Ok:
+	case bot.NoUserEmail:
+		r.Log(bot.Error, fmt.Sprintf("Can't elevate user %s with emailotp, no email address", r.user()))
+		r.Reply("Sorry, I don't have an email address to send you a code")
+		return bot.MechanismFail
+	default:
+		r.Log(bot.Error, fmt.Sprintf("Emailing one-time code to user %s failed: %s", r.user(), ret))
+		r.Reply("Sorry, I wasn't able to email you a code - ask an administrator to check the log")
+		return bot.MechanismFail
+	}
+	which := "elevation"
+	if immediate {
+		which = "immediate elevation"
+	}
+	dm := ""
+	if r.inChannel() {
+		dm = " - I'll message you directly"
+	}
+	r.Say(fmt.Sprintf("This command requires %s; I've emailed you a %d-digit code%s", which, cfg.CodeLength, dm))
+	r.Pause(1)
+	// The stock OTP matcher only takes 6 digits
+	regexID := "OTP"
+	if cfg.CodeLength != 6 {
+		regexID = "code"
+	}
+	prompt := "Please give me the code from your email"
+	for attempts := 0; attempts < cfg.MaxAttempts; {
+		rep, ret := r.promptDirect(regexID, prompt)
+		if time.Now().After(expires) {
+			r.sayDirect("Sorry, that code has expired")
+			r.Log(bot.Warn, fmt.Sprintf("One-time code for user %s expired", r.user()))
+			return bot.Fail
+		}
+		switch ret {
+		case bot.Ok:
+		case bot.TimeoutExpired, bot.ReplyNotMatched:
+			// email can be slow; keep waiting until the code expires
+			prompt = fmt.Sprintf("I still need the %d-digit code from your email", cfg.CodeLength)
+			continue
+		default:
+			r.Log(bot.Debug, fmt.Sprintf("User %s didn't provide the one-time code: %s", r.user(), ret))
+			return bot.Fail
+		}
+		rep = strings.TrimSpace(rep)
+		if len(rep) == len(code) && subtle.ConstantTimeCompare([]byte(rep), []byte(code)) == 1 {
+			return bot.Success
+		}
+		attempts++
+		r.Log(bot.Warn, fmt.Sprintf("User %s gave an invalid one-time code, attempt %d of %d", r.user(), attempts, cfg.MaxAttempts))
+		prompt = fmt.Sprintf("Invalid code, %d tries left; please give me the code from your email", cfg.MaxAttempts-attempts)
+	}
+	r.sayDirect("Sorry, too many invalid codes")
+	return bot.Fail
+}
+
+func emailotp(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
+	if command != "elevate" {
+		return
+	}
+	immediate := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "true", "True", "t", "T", "Yes", "yes", "Y":
+			immediate = true
+		}
+	}
+	var pcfg *config
+	if ret := r.GetPluginConfig(&pcfg); ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("emailotp couldn't get its configuration: %s", ret))
+		return bot.ConfigurationError
+	}
+	// the plugin's configuration is shared between calls, so defaults are
+	// filled in on a copy
+	c := *pcfg
+	cfg := &c
+	if err := checkConfig(cfg); err != nil {
+		r.Log(bot.Error, fmt.Sprintf("Invalid emailotp configuration: %v", err))
+		return bot.ConfigurationError
+	}
+	if !immediate && r.CheckElevationSession(cfg.TimeoutSeconds, cfg.TimeoutType) {
+		return bot.Success
+	}
+	retval = getcode(botRobot{r}, cfg, immediate)
+	if retval == bot.Success {
+		r.StartElevationSession(cfg.TimeoutSeconds)
+	}
+	return
+}
+
+const defaultConfig = `
+AllChannels: true
+AllowDirect: true
+ReplyMatchers:
+- Label: code
+  Regex: '\d{4,10}'
+Config:
+  CodeLength: 6
+  CodeExpiry: 300
+  MaxAttempts: 3
+  TimeoutSeconds: 7200
+  TimeoutType: idle # or absolute
+`
+
+func init() {
+	bot.RegisterPlugin("emailotp", bot.PluginHandler{
+		DefaultConfig: defaultConfig,
+		Handler:       emailotp,
+		Config:        &config{},
+	})
+}
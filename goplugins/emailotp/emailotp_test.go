@@ -0,0 +1,304 @@
+package emailotp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uva-its/gopherbot/bot"
+)
+
+// smtpListener is a minimal local SMTP server that hands each message it
+// receives to the messages channel.
+type smtpListener struct {
+	l        net.Listener
+	messages chan string
+}
+
+func newSMTPListener(t *testing.T) *smtpListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for SMTP: %v", err)
+	}
+	s := &smtpListener{l: l, messages: make(chan string, 10)}
+	go s.serve()
+	return s
+}
+
+func (s *smtpListener) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *smtpListener) close() {
+	s.l.Close()
+}
+
+func (s *smtpListener) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *smtpListener) session(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var msg bytes.Buffer
+			for {
+				dline, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dline == ".\r\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(dline, "."))
+			}
+			s.messages <- msg.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// fakeRobot implements otpRobot, emailing through the local listener and
+// answering prompts with the reply function.
+type fakeRobot struct {
+	mailhost string
+	address  string // the user's email address, empty for none
+	reply    func(prompt int, regexID string) (string, bot.RetVal)
+	prompts  int
+	said     []string
+}
+
+func (f *fakeRobot) Email(subject string, messageBody *bytes.Buffer) bot.RetVal {
+	if f.address == "" {
+		return bot.NoUserEmail
+	}
+	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", f.address, subject, messageBody.String())
+	if err := smtp.SendMail(f.mailhost, nil, "robot@example.com", []string{f.address}, []byte(msg)); err != nil {
+		return bot.MailError
+	}
+	return bot.Ok
+}
+
+func (f *fakeRobot) Say(msg string) bot.RetVal {
+	f.said = append(f.said, msg)
+	return bot.Ok
+}
+
+func (f *fakeRobot) Reply(msg string) bot.RetVal {
+	return f.Say(msg)
+}
+
+func (f *fakeRobot) Log(l bot.LogLevel, v ...interface{}) {}
+
+func (f *fakeRobot) Pause(s float64) {}
+
+func (f *fakeRobot) user() string {
+	return "alice"
+}
+
+func (f *fakeRobot) inChannel() bool {
+	return true
+}
+
+func (f *fakeRobot) sayDirect(msg string) bot.RetVal {
+	return f.Say(msg)
+}
+
+func (f *fakeRobot) promptDirect(regexID, prompt string) (string, bot.RetVal) {
+	f.prompts++
+	return f.reply(f.prompts, regexID)
+}
+
+func (f *fakeRobot) saidContaining(s string) bool {
+	for _, msg := range f.said {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var codeRe = regexp.MustCompile(`Your one-time code is: (\S+)`)
+
+// emailedCode waits for a message on the listener and returns the code in it
+func emailedCode(t *testing.T, s *smtpListener) string {
+	select {
+	case msg := <-s.messages:
+		m := codeRe.FindStringSubmatch(msg)
+		if m == nil {
+			t.Fatalf("No code found in email: %q", msg)
+		}
+		return m[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email received")
+	}
+	return ""
+}
+
+func testConfig(t *testing.T, cfg config) *config {
+	if err := checkConfig(&cfg); err != nil {
+		t.Fatalf("checkConfig: %v", err)
+	}
+	return &cfg
+}
+
+func TestNewCode(t *testing.T) {
+	for length := minCodeLength; length <= maxCodeLength; length++ {
+		re := regexp.MustCompile(fmt.Sprintf(`^\d{%d}$`, length))
+		for i := 0; i < 100; i++ {
+			code, err := newCode(length)
+			if err != nil {
+				t.Fatalf("newCode(%d): %v", length, err)
+			}
+			if !re.MatchString(code) {
+				t.Fatalf("newCode(%d) gave %q", length, code)
+			}
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfg := config{}
+	if err := checkConfig(&cfg); err != nil {
+		t.Fatalf("checkConfig on an empty config: %v", err)
+	}
+	if cfg.CodeLength != defaultCodeLength || cfg.CodeExpiry != defaultCodeExpiry || cfg.MaxAttempts != defaultMaxAttempts {
+		t.Errorf("Defaults not filled in: %+v", cfg)
+	}
+	for _, bad := range []config{
+		{CodeLength: minCodeLength - 1},
+		{CodeLength: maxCodeLength + 1},
+		{CodeExpiry: -1},
+		{MaxAttempts: -1},
+		{TimeoutType: "forever"},
+	} {
+		c := bad
+		if err := checkConfig(&c); err == nil {
+			t.Errorf("checkConfig accepted %+v", bad)
+		}
+	}
+}
+
+func TestGetcodeSuccess(t *testing.T) {
+	s := newSMTPListener(t)
+	defer s.close()
+	for _, length := range []int{6, 8} {
+		var regexID string
+		f := &fakeRobot{mailhost: s.addr(), address: "alice@example.com"}
+		f.reply = func(prompt int, id string) (string, bot.RetVal) {
+			regexID = id
+			return " " + emailedCode(t, s) + " ", bot.Ok
+		}
+		cfg := testConfig(t, config{CodeLength: length})
+		if ret := getcode(f, cfg, false); ret != bot.Success {
+			t.Errorf("Length %d: getcode returned %d, want Success", length, ret)
+		}
+		want := "OTP"
+		if length != 6 {
+			want = "code"
+		}
+		if regexID != want {
+			t.Errorf("Length %d: prompted with regex ID %q, want %q", length, regexID, want)
+		}
+		if !f.saidContaining(fmt.Sprintf("%d-digit code", length)) {
+			t.Errorf("Length %d: user wasn't told the code length: %q", length, f.said)
+		}
+	}
+}
+
+func TestGetcodeAttempts(t *testing.T) {
+	s := newSMTPListener(t)
+	defer s.close()
+	var code string
+	f := &fakeRobot{mailhost: s.addr(), address: "alice@example.com"}
+	f.reply = func(prompt int, id string) (string, bot.RetVal) {
+		if prompt == 1 {
+			code = emailedCode(t, s)
+			// waiting for the email doesn't count as an attempt
+			return "", bot.TimeoutExpired
+		}
+		return strings.Repeat("0", len(code)-1) + "x", bot.Ok
+	}
+	cfg := testConfig(t, config{MaxAttempts: 3})
+	if ret := getcode(f, cfg, false); ret != bot.Fail {
+		t.Errorf("getcode returned %d after invalid codes, want Fail", ret)
+	}
+	if f.prompts != 4 {
+		t.Errorf("Prompted %d times, want 4", f.prompts)
+	}
+	if !f.saidContaining("too many invalid codes") {
+		t.Errorf("User wasn't told about too many invalid codes: %q", f.said)
+	}
+}
+
+func TestGetcodeExpiry(t *testing.T) {
+	s := newSMTPListener(t)
+	defer s.close()
+	f := &fakeRobot{mailhost: s.addr(), address: "alice@example.com"}
+	f.reply = func(prompt int, id string) (string, bot.RetVal) {
+		code := emailedCode(t, s)
+		time.Sleep(1100 * time.Millisecond)
+		return code, bot.Ok
+	}
+	cfg := testConfig(t, config{CodeExpiry: 1})
+	if ret := getcode(f, cfg, true); ret != bot.Fail {
+		t.Errorf("getcode returned %d for an expired code, want Fail", ret)
+	}
+	if !f.saidContaining("expired") {
+		t.Errorf("User wasn't told the code expired: %q", f.said)
+	}
+}
+
+func TestGetcodeNoUserEmail(t *testing.T) {
+	s := newSMTPListener(t)
+	defer s.close()
+	f := &fakeRobot{mailhost: s.addr()}
+	f.reply = func(prompt int, id string) (string, bot.RetVal) {
+		t.Fatal("Prompted for a code that couldn't be sent")
+		return "", bot.Ok
+	}
+	if ret := getcode(f, testConfig(t, config{}), false); ret != bot.MechanismFail {
+		t.Errorf("getcode returned %d with no user email, want MechanismFail", ret)
+	}
+	if !f.saidContaining("don't have an email address") {
+		t.Errorf("User wasn't told they have no email address: %q", f.said)
+	}
+	select {
+	case msg := <-s.messages:
+		t.Errorf("Email sent without a user address: %q", msg)
+	default:
+	}
+}
@@ -0,0 +1,179 @@
+package ldapcheck
+
+/* ber.go - just enough ASN.1 BER encoding and decoding for the LDAP
+   operations the plugin uses. */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER identifier classes
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// Universal tags
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10 | constructed
+	tagSet         = 0x11 | constructed
+)
+
+// the largest element we're willing to read, to guard against garbage
+const maxElementSize = 16 * 1024 * 1024
+
+// element is a decoded BER element; constructed elements have children
+type element struct {
+	tag      byte // the full identifier octet
+	value    []byte
+	children []*element
+}
+
+func (e *element) isConstructed() bool {
+	return e.tag&constructed != 0
+}
+
+// encodeLength encodes a definite length
+func encodeLength(l int) []byte {
+	if l < 0x80 {
+		return []byte{byte(l)}
+	}
+	var b []byte
+	for ; l > 0; l >>= 8 {
+		b = append([]byte{byte(l)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// tlv encodes a single element from its identifier and contents
+func tlv(tag byte, contents []byte) []byte {
+	b := append([]byte{tag}, encodeLength(len(contents))...)
+	return append(b, contents...)
+}
+
+// wrap encodes a constructed element from encoded children
+func wrap(tag byte, children ...[]byte) []byte {
+	var contents []byte
+	for _, c := range children {
+		contents = append(contents, c...)
+	}
+	return tlv(tag, contents)
+}
+
+func berInteger(tag byte, i int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(i)}, b...)
+		if (i >= -0x80 && i < 0x80) || len(b) == 8 {
+			break
+		}
+		i >>= 8
+	}
+	return tlv(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return tlv(tag, []byte(s))
+}
+
+func berBool(tag byte, v bool) []byte {
+	if v {
+		return tlv(tag, []byte{0xff})
+	}
+	return tlv(tag, []byte{0x00})
+}
+
+// readElement reads and decodes one complete element
+func readElement(r *bufio.Reader) (*element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag&0x1f == 0x1f {
+		return nil, errors.New("multi-byte BER tags aren't supported")
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(l)
+	if l&0x80 != 0 {
+		n := int(l & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("unsupported BER length encoding 0x%02x", l)
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxElementSize {
+		return nil, fmt.Errorf("BER element too large: %d bytes", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return decodeElement(tag, value)
+}
+
+// decodeElement decodes the children of constructed elements
+func decodeElement(tag byte, value []byte) (*element, error) {
+	e := &element{tag: tag, value: value}
+	if !e.isConstructed() {
+		return e, nil
+	}
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, errors.New("truncated BER element")
+		}
+		ctag, l := value[0], int(value[1])
+		hdr := 2
+		if l&0x80 != 0 {
+			n := l & 0x7f
+			if n == 0 || n > 4 || len(value) < 2+n {
+				return nil, errors.New("invalid BER length")
+			}
+			l = 0
+			for _, b := range value[2 : 2+n] {
+				l = l<<8 | int(b)
+			}
+			hdr += n
+		}
+		if l < 0 || len(value) < hdr+l {
+			return nil, errors.New("truncated BER element")
+		}
+		child, err := decodeElement(ctag, value[hdr:hdr+l])
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, child)
+		value = value[hdr+l:]
+	}
+	return e, nil
+}
+
+// integer decodes an INTEGER or ENUMERATED value
+func (e *element) integer() (int64, error) {
+	if len(e.value) == 0 || len(e.value) > 8 {
+		return 0, fmt.Errorf("invalid BER integer length %d", len(e.value))
+	}
+	i := int64(int8(e.value[0]))
+	for _, b := range e.value[1:] {
+		i = i<<8 | int64(b)
+	}
+	return i, nil
+}
@@ -0,0 +1,277 @@
+package ldapcheck
+
+/* client.go - a minimal LDAPv3 client: connect (ldap:// with optional
+   StartTLS, or ldaps://), simple bind, and search. Each lookup uses its
+   own short-lived connection with a deadline covering the whole exchange. */
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP protocol operation tags, RFC 4511
+const (
+	opBindRequest       = classApplication | constructed | 0
+	opBindResponse      = classApplication | constructed | 1
+	opUnbindRequest     = classApplication | 2
+	opSearchRequest     = classApplication | constructed | 3
+	opSearchEntry       = classApplication | constructed | 4
+	opSearchDone        = classApplication | constructed | 5
+	opSearchReference   = classApplication | constructed | 19
+	opExtendedRequest   = classApplication | constructed | 23
+	opExtendedResponse  = classApplication | constructed | 24
+	startTLSOID         = "1.3.6.1.4.1.1466.20037"
+	resultSuccess       = 0
+	resultSizeExceeded  = 4
+	resultNoSuchObject  = 32
+	scopeWholeSubtree   = 2
+	derefNever          = 0
+	noAttributes        = "1.1"
+	defaultLDAPPort     = "389"
+	defaultLDAPSPort    = "636"
+	maxSearchResultSize = 100
+)
+
+// ldapError is a non-success result from the server
+type ldapError struct {
+	code    int64
+	message string
+}
+
+func (e *ldapError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("LDAP result code %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("LDAP result code %d", e.code)
+}
+
+// entry is a search result
+type entry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+type conn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	msgID int64
+}
+
+// dial connects to an ldap:// or ldaps:// URL, negotiating StartTLS if
+// requested, with every operation bounded by the deadline.
+func dial(rawurl string, startTLS, insecure bool, deadline time.Time) (*conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing LDAP URL \"%s\": %v", rawurl, err)
+	}
+	host := u.Host
+	var useTLS bool
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultLDAPPort)
+		}
+	case "ldaps":
+		useTLS = true
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultLDAPSPort)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme \"%s\"", u.Scheme)
+	}
+	if useTLS && startTLS {
+		return nil, errors.New("StartTLS can't be used with an ldaps:// URL")
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: insecure}
+	nc, err := net.DialTimeout("tcp", host, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(deadline)
+	if useTLS {
+		tc := tls.Client(nc, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	lc := &conn{c: nc, r: bufio.NewReader(nc)}
+	if startTLS {
+		resp, err := lc.roundTrip(wrap(opExtendedRequest, berString(classContext|0, startTLSOID)), opExtendedResponse)
+		if err == nil {
+			err = checkResult(resp)
+		}
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("StartTLS: %v", err)
+		}
+		tc := tls.Client(nc, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		lc.c, lc.r = tc, bufio.NewReader(tc)
+	}
+	return lc, nil
+}
+
+// send writes an LDAPMessage with the next message ID
+func (lc *conn) send(op []byte) (int64, error) {
+	lc.msgID++
+	msg := wrap(tagSequence, berInteger(tagInteger, lc.msgID), op)
+	_, err := lc.c.Write(msg)
+	return lc.msgID, err
+}
+
+// receive reads the next LDAPMessage for the message ID, returning the
+// protocol op element
+func (lc *conn) receive(id int64) (*element, error) {
+	for {
+		msg, err := readElement(lc.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errors.New("malformed LDAP message")
+		}
+		msgID, err := msg.children[0].integer()
+		if err != nil {
+			return nil, err
+		}
+		if msgID == 0 {
+			// unsolicited notification, e.g. notice of disconnection
+			return nil, errors.New("server sent an unsolicited notification")
+		}
+		if msgID != id {
+			continue
+		}
+		return msg.children[1], nil
+	}
+}
+
+// roundTrip sends a request and waits for the response of the given type
+func (lc *conn) roundTrip(op []byte, respTag byte) (*element, error) {
+	id, err := lc.send(op)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := lc.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if resp.tag != respTag {
+		return nil, fmt.Errorf("unexpected LDAP response type 0x%02x", resp.tag)
+	}
+	return resp, nil
+}
+
+// checkResult returns an error for a non-success LDAPResult
+func checkResult(resp *element) error {
+	if len(resp.children) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	code, err := resp.children[0].integer()
+	if err != nil {
+		return err
+	}
+	if code != resultSuccess {
+		return &ldapError{code, string(resp.children[2].value)}
+	}
+	return nil
+}
+
+// bind does a simple bind; an empty DN and password is an anonymous bind
+func (lc *conn) bind(dn, password string) error {
+	req := wrap(opBindRequest,
+		berInteger(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(classContext|0, password),
+	)
+	resp, err := lc.roundTrip(req, opBindResponse)
+	if err != nil {
+		return err
+	}
+	return checkResult(resp)
+}
+
+// search does a subtree search, returning up to sizeLimit entries. Results
+// beyond the limit are reported by the server as resultSizeExceeded, which
+// is returned along with the entries that were sent.
+func (lc *conn) search(base, filter string, attrs []string, sizeLimit int) ([]entry, error) {
+	f, err := compileFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter \"%s\": %v", filter, err)
+	}
+	attrList := make([][]byte, len(attrs))
+	for i, a := range attrs {
+		attrList[i] = berString(tagOctetString, a)
+	}
+	req := wrap(opSearchRequest,
+		berString(tagOctetString, base),
+		berInteger(tagEnumerated, scopeWholeSubtree),
+		berInteger(tagEnumerated, derefNever),
+		berInteger(tagInteger, int64(sizeLimit)),
+		berInteger(tagInteger, 0),
+		berBool(tagBoolean, false),
+		f,
+		wrap(tagSequence, attrList...),
+	)
+	id, err := lc.send(req)
+	if err != nil {
+		return nil, err
+	}
+	var entries []entry
+	for {
+		resp, err := lc.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case opSearchEntry:
+			if len(entries) >= maxSearchResultSize {
+				continue
+			}
+			e, err := parseEntry(resp)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case opSearchReference:
+			// referrals aren't followed
+		case opSearchDone:
+			return entries, checkResult(resp)
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response type 0x%02x", resp.tag)
+		}
+	}
+}
+
+func parseEntry(resp *element) (entry, error) {
+	if len(resp.children) < 2 {
+		return entry{}, errors.New("malformed search result entry")
+	}
+	e := entry{dn: string(resp.children[0].value), attrs: make(map[string][]string)}
+	for _, attr := range resp.children[1].children {
+		if len(attr.children) < 2 {
+			return entry{}, errors.New("malformed attribute in search result entry")
+		}
+		name := strings.ToLower(string(attr.children[0].value))
+		for _, v := range attr.children[1].children {
+			e.attrs[name] = append(e.attrs[name], string(v.value))
+		}
+	}
+	return e, nil
+}
+
+// close sends an unbind request and closes the connection
+func (lc *conn) close() {
+	lc.send(tlv(opUnbindRequest, nil))
+	lc.c.Close()
+}
@@ -0,0 +1,223 @@
+package ldapcheck
+
+/* filter.go - compiling RFC 4515 string filters, e.g.
+   "(&(cn=admins)(member=uid=jdoe,ou=people,dc=example,dc=edu))", into
+   their BER encoding for search requests. */
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choice tags, RFC 4511 section 4.5.1
+const (
+	filterAnd            = classContext | constructed | 0
+	filterOr             = classContext | constructed | 1
+	filterNot            = classContext | constructed | 2
+	filterEquality       = classContext | constructed | 3
+	filterSubstrings     = classContext | constructed | 4
+	filterGreaterOrEqual = classContext | constructed | 5
+	filterLessOrEqual    = classContext | constructed | 6
+	filterPresent        = classContext | 7
+	filterApprox         = classContext | constructed | 8
+	filterExtensible     = classContext | constructed | 9
+)
+
+// escapeFilter escapes a value for substituting into a filter string
+func escapeFilter(s string) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '*', '(', ')', '\\', 0:
+			escaped = append(escaped, []byte(fmt.Sprintf("\\%02x", c))...)
+		default:
+			escaped = append(escaped, c)
+		}
+	}
+	return string(escaped)
+}
+
+// unescapeFilter decodes \XX escapes in a filter value
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("truncated escape in filter value \"%s\"", s)
+		}
+		d, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in filter value \"%s\"", s)
+		}
+		b = append(b, d[0])
+		i += 2
+	}
+	return string(b), nil
+}
+
+// compileFilter compiles a string filter to BER
+func compileFilter(f string) ([]byte, error) {
+	f = strings.TrimSpace(f)
+	if !strings.HasPrefix(f, "(") {
+		// be forgiving of a bare "attr=value"
+		f = "(" + f + ")"
+	}
+	ber, rest, err := parseFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected \"%s\" after filter", rest)
+	}
+	return ber, nil
+}
+
+// parseFilter parses one parenthesized filter, returning its encoding and
+// the remainder of the string
+func parseFilter(f string) ([]byte, string, error) {
+	if len(f) < 2 || f[0] != '(' {
+		return nil, "", fmt.Errorf("filter must start with '(': \"%s\"", f)
+	}
+	f = f[1:]
+	switch f[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if f[0] == '|' {
+			tag = filterOr
+		}
+		f = f[1:]
+		var children [][]byte
+		for len(f) > 0 && f[0] == '(' {
+			child, rest, err := parseFilter(f)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			f = rest
+		}
+		if len(f) == 0 || f[0] != ')' {
+			return nil, "", fmt.Errorf("missing ')' in filter")
+		}
+		return wrap(tag, children...), f[1:], nil
+	case '!':
+		child, rest, err := parseFilter(f[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", fmt.Errorf("missing ')' in filter")
+		}
+		return wrap(filterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(f, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("missing ')' in filter")
+	}
+	item, err := parseItem(f[:end])
+	if err != nil {
+		return nil, "", err
+	}
+	return item, f[end+1:], nil
+}
+
+// parseItem parses a simple, present, substring or extensible filter item
+func parseItem(item string) ([]byte, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("invalid filter item \"%s\"", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case ':':
+		return parseExtensible(attr[:len(attr)-1], value)
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("missing attribute in filter item \"%s\"", item)
+	}
+	if tag == filterEquality && value == "*" {
+		return berString(filterPresent, attr), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		return parseSubstrings(attr, value)
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(tag, berString(tagOctetString, attr), berString(tagOctetString, v)), nil
+}
+
+// parseSubstrings handles values with wildcards, e.g. "cn=adm*ins*"
+func parseSubstrings(attr, value string) ([]byte, error) {
+	parts := strings.Split(value, "*")
+	var subs [][]byte
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		v, err := unescapeFilter(p)
+		if err != nil {
+			return nil, err
+		}
+		var tag byte = classContext | 1 // any
+		switch i {
+		case 0:
+			tag = classContext | 0 // initial
+		case len(parts) - 1:
+			tag = classContext | 2 // final
+		}
+		subs = append(subs, berString(tag, v))
+	}
+	return wrap(filterSubstrings, berString(tagOctetString, attr), wrap(tagSequence, subs...)), nil
+}
+
+// parseExtensible handles "attr:dn:rule:=value" forms, e.g. the Active
+// Directory nested group rule "member:1.2.840.113556.1.4.1941:=<dn>"
+func parseExtensible(lhs, value string) ([]byte, error) {
+	var rule, attr string
+	dnAttrs := false
+	for i, part := range strings.Split(lhs, ":") {
+		switch {
+		case i == 0:
+			attr = part
+		case strings.EqualFold(part, "dn"):
+			dnAttrs = true
+		default:
+			rule = part
+		}
+	}
+	if attr == "" && rule == "" {
+		return nil, fmt.Errorf("extensible filter needs an attribute or matching rule")
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	var parts [][]byte
+	if rule != "" {
+		parts = append(parts, berString(classContext|1, rule))
+	}
+	if attr != "" {
+		parts = append(parts, berString(classContext|2, attr))
+	}
+	parts = append(parts, berString(classContext|3, v))
+	if dnAttrs {
+		parts = append(parts, berBool(classContext|4, true))
+	}
+	return wrap(filterExtensible, parts...), nil
+}
@@ -0,0 +1,269 @@
+// Package ldapcheck is an authorizer plugin that checks a user's membership
+// in the LDAP / Active Directory group named by a plugin's AuthRequire.
+// The user is looked up by their handle or email (or another attribute
+// from GetUserAttribute), results are cached, and any failure talking to
+// the directory returns MechanismFail.
+package ldapcheck
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uva-its/gopherbot/bot"
+)
+
+const (
+	defaultUserFilter  = "(mail={user})"
+	defaultGroupFilter = "(&(cn={group})(member={userdn}))"
+	defaultTimeout     = 10
+	defaultCacheTime   = 300
+)
+
+type config struct {
+	LDAPURL            string // ldap://host(:port) or ldaps://host(:port)
+	StartTLS           bool   // Upgrade an ldap:// connection with StartTLS
+	InsecureSkipVerify bool   // Don't verify the server certificate; only for testing
+	BindDN             string // DN to bind as; anonymous if empty
+	BindPassword       string
+	BaseDN             string // Where to search for users
+	UserAttribute      string // handle, email, emailUser, or another attribute from GetUserAttribute
+	UserFilter         string // Filter to find the user; {user} is replaced with the user attribute
+	GroupBaseDN        string // Where to search for groups; defaults to BaseDN
+	GroupFilter        string // Filter that matches the group if the user is a member; {group}, {user} and {userdn} are replaced
+	TimeoutSeconds     int    // Timeout for the whole lookup, default 10
+	CacheSeconds       int    // How long to cache results, default 300; -1 disables caching
+}
+
+type cacheKey struct {
+	user, group string
+}
+
+type cacheEntry struct {
+	member  bool
+	expires time.Time
+}
+
+var cache = struct {
+	m map[cacheKey]cacheEntry
+	sync.Mutex
+}{
+	make(map[cacheKey]cacheEntry),
+	sync.Mutex{},
+}
+
+// userID gets the value substituted for {user} in filters
+func userID(r *bot.Robot, attr string) (string, error) {
+	switch attr {
+	case "handle":
+		return r.User, nil
+	case "", "email":
+		attr = "email"
+	case "emailUser", "emailuser":
+		email, err := userID(r, "email")
+		if err != nil {
+			return "", err
+		}
+		return strings.Split(email, "@")[0], nil
+	}
+	a := r.GetSenderAttribute(attr)
+	if a.RetVal != bot.Ok || a.Attribute == "" {
+		return "", fmt.Errorf("couldn't get attribute \"%s\" for user \"%s\": %s", attr, r.User, a.RetVal)
+	}
+	return a.Attribute, nil
+}
+
+// isMember looks up the user in the directory, then checks whether the
+// group filter matches.
+func isMember(cfg *config, user, group string) (bool, error) {
+	timeout := cfg.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	lc, err := dial(cfg.LDAPURL, cfg.StartTLS, cfg.InsecureSkipVerify, time.Now().Add(time.Duration(timeout)*time.Second))
+	if err != nil {
+		return false, fmt.Errorf("connecting to %s: %v", cfg.LDAPURL, err)
+	}
+	defer lc.close()
+	if cfg.BindDN != "" {
+		if err := lc.bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			return false, fmt.Errorf("binding as \"%s\": %v", cfg.BindDN, err)
+		}
+	}
+	userFilter := cfg.UserFilter
+	if userFilter == "" {
+		userFilter = defaultUserFilter
+	}
+	userFilter = strings.Replace(userFilter, "{user}", escapeFilter(user), -1)
+	users, err := lc.search(cfg.BaseDN, userFilter, []string{noAttributes}, 2)
+	if lerr, ok := err.(*ldapError); ok && lerr.code == resultSizeExceeded || err == nil && len(users) > 1 {
+		return false, fmt.Errorf("user filter \"%s\" matched more than one entry", userFilter)
+	}
+	if err != nil {
+		return false, fmt.Errorf("searching for user with \"%s\": %v", userFilter, err)
+	}
+	if len(users) == 0 {
+		return false, nil
+	}
+	groupFilter := cfg.GroupFilter
+	if groupFilter == "" {
+		groupFilter = defaultGroupFilter
+	}
+	groupFilter = strings.NewReplacer(
+		"{group}", escapeFilter(group),
+		"{userdn}", escapeFilter(users[0].dn),
+		"{user}", escapeFilter(user),
+	).Replace(groupFilter)
+	groupBase := cfg.GroupBaseDN
+	if groupBase == "" {
+		groupBase = cfg.BaseDN
+	}
+	groups, err := lc.search(groupBase, groupFilter, []string{noAttributes}, 1)
+	if lerr, ok := err.(*ldapError); ok && lerr.code == resultSizeExceeded {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("searching for group with \"%s\": %v", groupFilter, err)
+	}
+	return len(groups) > 0, nil
+}
+
+// cached returns the user's cached membership in the group, if there's an
+// unexpired entry.
+func cached(key cacheKey, now time.Time) (member, ok bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	c, ok := cache.m[key]
+	if ok && !now.Before(c.expires) {
+		delete(cache.m, key)
+		return false, false
+	}
+	return c.member, ok
+}
+
+// store caches a membership result, and removes expired entries so the
+// cache doesn't grow without bound.
+func store(key cacheKey, member bool, now time.Time, ttl time.Duration) {
+	cache.Lock()
+	defer cache.Unlock()
+	for k, c := range cache.m {
+		if !now.Before(c.expires) {
+			delete(cache.m, k)
+		}
+	}
+	cache.m[key] = cacheEntry{member, now.Add(ttl)}
+}
+
+// clearCache drops all cached results, e.g. when the configuration changes
+func clearCache() {
+	cache.Lock()
+	cache.m = make(map[cacheKey]cacheEntry)
+	cache.Unlock()
+}
+
+// membership checks the directory for the user, identified by the value
+// for {user}, caching the result under key. It returns Success or Fail,
+// or MechanismFail with the error if the lookup failed.
+func membership(cfg *config, key cacheKey, user string) (bot.PlugRetVal, error) {
+	member, err := isMember(cfg, user, key.group)
+	if err != nil {
+		return bot.MechanismFail, err
+	}
+	if cfg.CacheSeconds >= 0 {
+		ttl := cfg.CacheSeconds
+		if ttl == 0 {
+			ttl = defaultCacheTime
+		}
+		store(key, member, time.Now(), time.Duration(ttl)*time.Second)
+	}
+	if member {
+		return bot.Success, nil
+	}
+	return bot.Fail, nil
+}
+
+// authorize handles the arguments from checkAuthorization: the plugin
+// name, AuthRequire (the group), the command and its arguments.
+func authorize(r *bot.Robot, args []string) (retval bot.PlugRetVal) {
+	if len(args) < 3 {
+		r.Log(bot.Error, fmt.Sprintf("ldapcheck called with too few arguments: %q", args))
+		return bot.MechanismFail
+	}
+	plugin, group, command := args[0], args[1], args[2]
+	if group == "" {
+		r.Log(bot.Error, fmt.Sprintf("ldapcheck called for command \"%s\" in plugin \"%s\" with no AuthRequire group", command, plugin))
+		return bot.ConfigurationError
+	}
+	var cfg *config
+	if ret := r.GetPluginConfig(&cfg); ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("ldapcheck couldn't get its configuration: %s", ret))
+		return bot.ConfigurationError
+	}
+	if cfg.LDAPURL == "" || cfg.BaseDN == "" {
+		r.Log(bot.Error, "ldapcheck needs LDAPURL and BaseDN configured")
+		return bot.ConfigurationError
+	}
+	// results are cached by canonical identity, so a user who takes
+	// over another's handle doesn't get their cached membership
+	key := cacheKey{r.CanonicalUser(), group}
+	if cfg.CacheSeconds >= 0 {
+		if member, ok := cached(key, time.Now()); ok {
+			r.Log(bot.Debug, fmt.Sprintf("ldapcheck using cached membership of user \"%s\" in group \"%s\": %t", r.User, group, member))
+			if member {
+				return bot.Success
+			}
+			return bot.Fail
+		}
+	}
+	user, err := userID(r, cfg.UserAttribute)
+	if err != nil {
+		r.Log(bot.Error, fmt.Sprintf("ldapcheck %v", err))
+		return bot.MechanismFail
+	}
+	retval, err = membership(cfg, key, user)
+	switch {
+	case err != nil:
+		r.Log(bot.Error, fmt.Sprintf("ldapcheck lookup failed for user \"%s\" (%s) in group \"%s\": %v", r.User, user, group, err))
+	case retval == bot.Success:
+		r.Log(bot.Debug, fmt.Sprintf("ldapcheck found user \"%s\" (%s) in group \"%s\"", r.User, user, group))
+	default:
+		r.Log(bot.Debug, fmt.Sprintf("ldapcheck didn't find user \"%s\" (%s) in group \"%s\"", r.User, user, group))
+	}
+	return retval
+}
+
+func ldapcheck(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
+	switch command {
+	case "init", "reload":
+		// configuration may have changed
+		clearCache()
+	case "authorize":
+		return authorize(r, args)
+	}
+	return
+}
+
+const defaultConfig = `
+AllChannels: true
+AllowDirect: true
+Config:
+#  LDAPURL: ldaps://ldap.example.edu
+#  BaseDN: "ou=people,dc=example,dc=edu"
+#  GroupBaseDN: "ou=groups,dc=example,dc=edu"
+#  BindDN: "cn=gopherbot,ou=services,dc=example,dc=edu"
+#  BindPassword: <password>
+  UserAttribute: email
+  UserFilter: "(mail={user})"
+  GroupFilter: "(&(cn={group})(member={userdn}))"
+  TimeoutSeconds: 10
+  CacheSeconds: 300
+`
+
+func init() {
+	bot.RegisterPlugin("ldapcheck", bot.PluginHandler{
+		DefaultConfig: defaultConfig,
+		Handler:       ldapcheck,
+		Config:        &config{},
+	})
+}
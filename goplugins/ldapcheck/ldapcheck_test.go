@@ -0,0 +1,289 @@
+package ldapcheck
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uva-its/gopherbot/bot"
+)
+
+const (
+	testBindDN               = "cn=gopherbot,ou=services,dc=example,dc=edu"
+	testPassword             = "secret"
+	testBaseDN               = "ou=people,dc=example,dc=edu"
+	aliceDN                  = "uid=alice,ou=people,dc=example,dc=edu"
+	resultInvalidCredentials = 49
+)
+
+// fakeDirectory is an in-process LDAP server. Searches are answered from
+// results, keyed by the filter string the client is expected to send.
+type fakeDirectory struct {
+	l       net.Listener
+	results map[string][]string // filter -> matching DNs
+	stall   bool                // never answer searches
+	sync.Mutex
+	binds, searches int
+}
+
+func newFakeDirectory(t *testing.T, results map[string][]string) *fakeDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening for LDAP: %v", err)
+	}
+	d := &fakeDirectory{l: l, results: results}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(c)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDirectory) url() string {
+	return "ldap://" + d.l.Addr().String()
+}
+
+func (d *fakeDirectory) close() {
+	d.l.Close()
+}
+
+func (d *fakeDirectory) counts() (binds, searches int) {
+	d.Lock()
+	defer d.Unlock()
+	return d.binds, d.searches
+}
+
+func (d *fakeDirectory) config() *config {
+	return &config{
+		LDAPURL:        d.url(),
+		BindDN:         testBindDN,
+		BindPassword:   testPassword,
+		BaseDN:         testBaseDN,
+		TimeoutSeconds: 5,
+	}
+}
+
+func ldapResult(op byte, code int64, message string) []byte {
+	return wrap(op, berInteger(tagEnumerated, code), berString(tagOctetString, ""), berString(tagOctetString, message))
+}
+
+func (d *fakeDirectory) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(id int64, op []byte) {
+		c.Write(wrap(tagSequence, berInteger(tagInteger, id), op))
+	}
+	for {
+		msg, err := readElement(r)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		id, _ := msg.children[0].integer()
+		op := msg.children[1]
+		switch op.tag {
+		case opBindRequest:
+			d.Lock()
+			d.binds++
+			d.Unlock()
+			if string(op.children[1].value) == testBindDN && string(op.children[2].value) == testPassword {
+				reply(id, ldapResult(opBindResponse, resultSuccess, ""))
+			} else {
+				reply(id, ldapResult(opBindResponse, resultInvalidCredentials, "invalid credentials"))
+			}
+		case opSearchRequest:
+			d.Lock()
+			d.searches++
+			stall := d.stall
+			d.Unlock()
+			if stall {
+				continue
+			}
+			sizeLimit, _ := op.children[3].integer()
+			filter := tlv(op.children[6].tag, op.children[6].value)
+			var dns []string
+			for f, matches := range d.results {
+				if enc, err := compileFilter(f); err == nil && bytes.Equal(enc, filter) {
+					dns = matches
+				}
+			}
+			code := int64(resultSuccess)
+			if sizeLimit > 0 && int64(len(dns)) > sizeLimit {
+				dns = dns[:sizeLimit]
+				code = resultSizeExceeded
+			}
+			for _, dn := range dns {
+				reply(id, wrap(opSearchEntry, berString(tagOctetString, dn), wrap(tagSequence)))
+			}
+			reply(id, ldapResult(opSearchDone, code, ""))
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func groupFilter(group, dn string) string {
+	return "(&(cn=" + group + ")(member=" + escapeFilter(dn) + "))"
+}
+
+func TestIsMember(t *testing.T) {
+	d := newFakeDirectory(t, map[string][]string{
+		"(mail=alice@example.com)":     {aliceDN},
+		groupFilter("admins", aliceDN): {"cn=admins,ou=groups,dc=example,dc=edu"},
+	})
+	defer d.close()
+	cfg := d.config()
+	for _, tc := range []struct {
+		user, group string
+		member      bool
+	}{
+		{"alice@example.com", "admins", true},
+		{"alice@example.com", "ops", false},
+		{"bob@example.com", "admins", false},
+	} {
+		member, err := isMember(cfg, tc.user, tc.group)
+		if err != nil {
+			t.Errorf("isMember(%s, %s): %v", tc.user, tc.group, err)
+			continue
+		}
+		if member != tc.member {
+			t.Errorf("isMember(%s, %s) = %t, want %t", tc.user, tc.group, member, tc.member)
+		}
+	}
+	binds, searches := d.counts()
+	if binds != 3 {
+		t.Errorf("Server saw %d binds, want 3", binds)
+	}
+	// bob isn't found, so there's no group search
+	if searches != 5 {
+		t.Errorf("Server saw %d searches, want 5", searches)
+	}
+}
+
+func TestBindFailure(t *testing.T) {
+	d := newFakeDirectory(t, nil)
+	defer d.close()
+	cfg := d.config()
+	cfg.BindPassword = "wrong"
+	_, err := isMember(cfg, "alice@example.com", "admins")
+	if err == nil || !strings.Contains(err.Error(), "binding as") || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Errorf("isMember with a bad password gave error %v, want a bind error", err)
+	}
+	if _, searches := d.counts(); searches != 0 {
+		t.Errorf("Server saw %d searches after a failed bind, want 0", searches)
+	}
+}
+
+func TestSizeExceeded(t *testing.T) {
+	d := newFakeDirectory(t, map[string][]string{
+		"(mail=shared@example.com)":    {aliceDN, "uid=bob,ou=people,dc=example,dc=edu", "uid=carol,ou=people,dc=example,dc=edu"},
+		"(mail=alice@example.com)":     {aliceDN},
+		groupFilter("admins", aliceDN): {"cn=admins,ou=groups,dc=example,dc=edu", "cn=admins,ou=legacy,dc=example,dc=edu"},
+	})
+	defer d.close()
+	cfg := d.config()
+	if _, err := isMember(cfg, "shared@example.com", "admins"); err == nil || !strings.Contains(err.Error(), "more than one entry") {
+		t.Errorf("Ambiguous user gave error %v, want a \"more than one entry\" error", err)
+	}
+	// more than one matching group still means the user is a member
+	member, err := isMember(cfg, "alice@example.com", "admins")
+	if err != nil || !member {
+		t.Errorf("Group search exceeding the size limit gave %t, %v; want true, nil", member, err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	d := newFakeDirectory(t, nil)
+	defer d.close()
+	d.Lock()
+	d.stall = true
+	d.Unlock()
+	cfg := d.config()
+	cfg.TimeoutSeconds = 1
+	start := time.Now()
+	_, err := isMember(cfg, "alice@example.com", "admins")
+	if err == nil {
+		t.Fatal("isMember with a stalled server didn't fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("isMember took %v to time out, want about 1s", elapsed)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	clearCache()
+	d := newFakeDirectory(t, map[string][]string{
+		"(mail=alice@example.com)":     {aliceDN},
+		groupFilter("admins", aliceDN): {"cn=admins,ou=groups,dc=example,dc=edu"},
+	})
+	cfg := d.config()
+	alice := cacheKey{"alice", "admins"}
+	if ret, err := membership(cfg, alice, "alice@example.com"); ret != bot.Success || err != nil {
+		t.Errorf("membership for a member gave %d, %v; want Success", ret, err)
+	}
+	if ret, err := membership(cfg, cacheKey{"alice", "ops"}, "alice@example.com"); ret != bot.Fail || err != nil {
+		t.Errorf("membership for a non-member gave %d, %v; want Fail", ret, err)
+	}
+	// lookup failures map to MechanismFail
+	bad := d.config()
+	bad.BindPassword = "wrong"
+	if ret, err := membership(bad, cacheKey{"bob", "admins"}, "bob@example.com"); ret != bot.MechanismFail || err == nil {
+		t.Errorf("membership with a bind failure gave %d, %v; want MechanismFail", ret, err)
+	}
+	d.close()
+	if ret, err := membership(cfg, cacheKey{"bob", "admins"}, "bob@example.com"); ret != bot.MechanismFail || err == nil {
+		t.Errorf("membership with the server down gave %d, %v; want MechanismFail", ret, err)
+	}
+	// results were cached, and failures weren't
+	if member, ok := cached(alice, time.Now()); !ok || !member {
+		t.Errorf("Cached membership for alice in admins is %t, %t; want true, true", member, ok)
+	}
+	if _, ok := cached(cacheKey{"bob", "admins"}, time.Now()); ok {
+		t.Error("A failed lookup was cached")
+	}
+	// CacheSeconds -1 disables caching
+	clearCache()
+	d = newFakeDirectory(t, map[string][]string{"(mail=alice@example.com)": {aliceDN}})
+	defer d.close()
+	cfg = d.config()
+	cfg.CacheSeconds = -1
+	membership(cfg, alice, "alice@example.com")
+	if _, ok := cached(alice, time.Now()); ok {
+		t.Error("Result cached with CacheSeconds -1")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	clearCache()
+	now := time.Now()
+	old := cacheKey{"alice", "admins"}
+	store(old, true, now, time.Second)
+	if _, ok := cached(old, now.Add(2*time.Second)); ok {
+		t.Error("Expired entry returned from the cache")
+	}
+	store(old, true, now, time.Second)
+	store(cacheKey{"bob", "admins"}, false, now.Add(2*time.Second), time.Minute)
+	cache.Lock()
+	_, ok := cache.m[old]
+	size := len(cache.m)
+	cache.Unlock()
+	if ok || size != 1 {
+		t.Errorf("Expired entries weren't pruned; cache has %d entries", size)
+	}
+	// the cache is cleared when the configuration is reloaded
+	ldapcheck(nil, "reload")
+	cache.Lock()
+	size = len(cache.m)
+	cache.Unlock()
+	if size != 0 {
+		t.Errorf("Cache has %d entries after reload, want 0", size)
+	}
+}
@@ -22,7 +22,8 @@ type config struct {
 // Define the handler function
 func links(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
 	// Create an empty map to unmarshal into
-	if command == "init" { // ignore init
+	switch command {
+	case "init", "reload", "shutdown": // ignore lifecycle hooks
 		return
 	}
 	links := make(map[string][]string)
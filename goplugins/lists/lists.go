@@ -28,7 +28,8 @@ func name(arg string) string {
 // Define the handler function
 func lists(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
 	// Create an empty map to unmarshal into
-	if command == "init" { // ignore init
+	switch command {
+	case "init", "reload", "shutdown": // ignore lifecycle hooks
 		return
 	}
 	var lists = make(map[string]itemList)
@@ -26,16 +26,17 @@ type MemeConfig struct {
 }
 
 func memegen(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
+	switch command {
+	case "init", "reload", "shutdown":
+		// ignore lifecycle hooks
+		return
+	}
 	var m *MemeConfig
 	ret := r.GetPluginConfig(&m) // make m point to a valid, thread-safe MemeConfig
 	if ret != bot.Ok || m.Password == "" {
-		if command != "init" {
-			r.Reply("I couldn't remember my password for the meme generator")
-		}
+		r.Reply("I couldn't remember my password for the meme generator")
 	}
 	switch command {
-	case "init":
-		// ignore
 	default:
 		url, err := createMeme(m, command, args[0], args[1])
 		if err == nil {
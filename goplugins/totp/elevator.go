@@ -2,54 +2,97 @@ package totp
 
 import (
 	"bytes"
-	"encoding/base32"
 	"fmt"
-	"math/rand"
-	"sync"
-	"time"
+	"net/url"
+	"strings"
 
-	otp "github.com/dgryski/dgoogauth"
 	"github.com/uva-its/gopherbot/bot"
 )
 
-var timeoutLock sync.RWMutex
-var lastElevate = make(map[string]time.Time)
-var random = rand.New(rand.NewSource(time.Now().UnixNano()))
-
-type timeoutType int
-
-const (
-	idle timeoutType = iota
-	absolute
-)
+// Permission required to reset another user's launch codes; see Roles in
+// gopherbot.yaml
+const resetPermission = "totp.reset"
 
 type config struct {
 	TimeoutSeconds int
-	tf64           float64
-	TimeoutType    string
-	tt             timeoutType
+	TimeoutType    string // idle or absolute, see bot.IdleTimeout
 }
 
 var cfg config
 
+// provisionURI gives the otpauth:// URI for enrolling in an authenticator,
+// labeled with the robot's name and the user's identity.
+func provisionURI(r *bot.Robot, user string, userOTP *launchCodes) string {
+	issuer := r.GetBotAttribute("name").Attribute
+	if issuer == "" {
+		issuer = "Gopherbot"
+	}
+	q := make(url.Values)
+	q.Set("secret", userOTP.Secret)
+	q.Set("issuer", issuer)
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+user) + "?" + q.Encode()
+}
+
+// migrateCodes moves launch codes saved under the user's chat handle, before
+// they were keyed by canonical identity, to the canonical key. The old datum
+// is reset so a later user with the same handle doesn't inherit it.
+func migrateCodes(r *bot.Robot, user string) {
+	if user == r.User {
+		return
+	}
+	var userOTP, old launchCodes
+	lock, exists, ret := r.CheckoutDatum(user, &userOTP, true)
+	if ret != bot.Ok || (exists && userOTP.enrolled()) {
+		r.CheckinDatum(user, lock)
+		return
+	}
+	oldLock, exists, ret := r.CheckoutDatum(r.User, &old, true)
+	if ret != bot.Ok || !exists || !old.enrolled() {
+		r.CheckinDatum(r.User, oldLock)
+		r.CheckinDatum(user, lock)
+		return
+	}
+	if ret = r.UpdateDatum(user, lock, &old); ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("Couldn't move OTP config for %s to %s: %s", r.User, user, ret))
+		r.CheckinDatum(r.User, oldLock)
+		return
+	}
+	if ret = r.UpdateDatum(r.User, oldLock, &launchCodes{}); ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("Couldn't reset old OTP config for %s after moving it to %s: %s", r.User, user, ret))
+	}
+	r.Log(bot.Info, fmt.Sprintf("Moved TOTP launch codes for \"%s\" to canonical identity \"%s\"", r.User, user))
+}
+
+// checkOTP checks a TOTP code or single-use recovery code
 func checkOTP(r *bot.Robot, code string) (bool, bot.PlugRetVal) {
-	var userOTP otp.OTPConfig
-	lock, exists, ret := r.CheckoutDatum(r.User, &userOTP, true)
+	var userOTP launchCodes
+	user := r.CanonicalUser()
+	lock, exists, ret := r.CheckoutDatum(user, &userOTP, true)
 	if ret != bot.Ok {
-		r.CheckinDatum(r.User, lock)
+		r.CheckinDatum(user, lock)
 		return false, bot.MechanismFail
 	}
-	if !exists {
-		r.CheckinDatum(r.User, lock)
+	if !exists || !userOTP.enrolled() {
+		r.CheckinDatum(user, lock)
 		return false, bot.MechanismFail
 	}
-	valid, err := userOTP.Authenticate(code)
-	if err != nil {
-		r.Log(bot.Error, fmt.Errorf("Problem authenticating launch code for user %s: %v", r.User, err))
-		r.CheckinDatum(r.User, lock)
-		return false, bot.MechanismFail
+	var valid bool
+	if isRecoveryCode(code) {
+		valid = userOTP.useRecoveryCode(code)
+		if valid {
+			r.Log(bot.Audit, fmt.Sprintf("User \"%s\" used a TOTP recovery code, %d left", r.User, len(userOTP.RecoveryCodes)))
+			r.Direct().Say(fmt.Sprintf("Recovery code accepted; you have %d left. You can get new launch codes with \"send launch codes\"", len(userOTP.RecoveryCodes)))
+		}
+	} else {
+		var err error
+		valid, err = userOTP.Authenticate(code)
+		if err != nil {
+			r.Log(bot.Error, fmt.Errorf("Problem authenticating launch code for user %s: %v", r.User, err))
+			r.CheckinDatum(user, lock)
+			return false, bot.MechanismFail
+		}
 	}
-	ret = r.UpdateDatum(r.User, lock, &userOTP)
+	ret = r.UpdateDatum(user, lock, &userOTP)
 	if ret != bot.Ok {
 		r.Log(bot.Error, fmt.Errorf("Problem updating OTP for %s, failing", r.User))
 		return false, bot.MechanismFail
@@ -68,9 +111,9 @@ func getcode(r *bot.Robot, immediate bool) (retval bot.PlugRetVal) {
 		r.Say("This command requires elevation" + dm)
 	}
 	r.Pause(1)
-	rep, ret := r.Direct().PromptForReply("OTP", "Please provide your totp launch code")
+	rep, ret := r.Direct().PromptForReply("launchcode", "Please provide your totp launch code (or a recovery code)")
 	if ret != bot.Ok {
-		rep, ret = r.Direct().PromptForReply("OTP", "Try again? I need a 6-digit launch code")
+		rep, ret = r.Direct().PromptForReply("launchcode", "Try again? I need a 6-digit launch code, or a recovery code like abcd-efgh")
 	}
 	if ret == bot.Ok {
 		ok, ret := checkOTP(r, rep)
@@ -88,50 +131,134 @@ func getcode(r *bot.Robot, immediate bool) (retval bot.PlugRetVal) {
 	return bot.Fail
 }
 
+// enroll generates a new secret and recovery codes and emails them to the
+// user, replacing any existing launch codes once the email is sent.
+func enroll(r *bot.Robot, user string) {
+	secret, err := newSecret()
+	var codes, hashes []string
+	if err == nil {
+		codes, hashes, err = newRecoveryCodes()
+	}
+	if err != nil {
+		r.Log(bot.Error, fmt.Sprintf("Generating launch codes for user %s: %v", r.User, err))
+		r.Reply("There was a problem generating your launch codes, contact an administrator")
+		return
+	}
+	userOTP := &launchCodes{RecoveryCodes: hashes}
+	userOTP.Secret = secret
+	userOTP.WindowSize = 2
+	userOTP.DisallowReuse = []int{}
+	uri := provisionURI(r, user, userOTP)
+	qr, err := qrPNG(uri)
+	if err != nil {
+		r.Log(bot.Error, fmt.Sprintf("Generating launch code QR code for user %s: %v", r.User, err))
+		r.Reply("There was a problem generating your launch codes, contact an administrator")
+		return
+	}
+	var codeMail bytes.Buffer
+	fmt.Fprintf(&codeMail, "Scan the attached QR code with your authenticator app, or add this secret manually:\n%s\n\n", secret)
+	fmt.Fprintf(&codeMail, "Enrollment URI:\n%s\n\n", uri)
+	fmt.Fprintf(&codeMail, "If you lose your authenticator, each of these recovery codes can be used once in place of a launch code:\n%s\n\n", strings.Join(codes, "\n"))
+	fmt.Fprintf(&codeMail, "Then tell me to \"verify launch code\" to make sure it's working.\n")
+	// Sending email takes a while, so the datum is only checked out after
+	if ret := r.EmailWithAttachments("Your launch codes - if you print this email, please chew it up and swallow it", &codeMail,
+		bot.EmailAttachment{Filename: "launchcodes.png", ContentType: "image/png", Content: qr}); ret != bot.Ok {
+		r.Reply("There was a problem sending your launch codes, contact an administrator")
+		return
+	}
+	var old launchCodes
+	lock, _, ret := r.CheckoutDatum(user, &old, true)
+	if ret == bot.Ok {
+		ret = r.UpdateDatum(user, lock, userOTP)
+	}
+	if ret != bot.Ok {
+		r.Log(bot.Error, fmt.Sprintf("Couldn't save OTP config for %s: %s", r.User, ret))
+		r.Reply("Good grief, I'm having trouble remembering your launch codes - have somebody check my log")
+		return
+	}
+	r.Reply("I've emailed your launch codes and recovery codes - please delete it promptly, then \"verify launch code\" to check your authenticator")
+}
+
 func elevate(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVal) {
+	// launch codes are stored under the user's canonical identity
+	user := r.CanonicalUser()
+	migrateCodes(r, user)
 	switch command {
 	case "send":
-		var userOTP otp.OTPConfig
-		updated := false
-		lock, exists, ret := r.CheckoutDatum(r.User, &userOTP, true)
+		var userOTP launchCodes
+		_, exists, ret := r.CheckoutDatum(user, &userOTP, false)
 		if ret != bot.Ok {
 			r.Say("Yikes! - Something went wrong with my brain, have an admin check my log")
 			return
 		}
-		defer func() {
-			if updated {
-				ret = r.UpdateDatum(r.User, lock, &userOTP)
-				if ret != bot.Ok {
-					r.Log(bot.Error, "Couldn't save OTP config")
-					r.Reply("Good grief, I'm having trouble remembering your launch codes - have somebody check my log")
-				}
-			} else {
-				// Well-behaved plugins will always do a CheckinDatum when the datum hasn't been updated,
-				// in case there's another thread waiting.
-				r.CheckinDatum(r.User, lock)
+		if exists && userOTP.enrolled() {
+			// Re-enrolling requires proof the user has the old codes
+			r.Reply("You already have launch codes; to replace them, I need a code from your current authenticator, or a recovery code")
+			if getcode(r, true) != bot.Success {
+				r.Log(bot.Audit, fmt.Sprintf("User \"%s\" failed elevation while trying to replace their TOTP launch codes", r.User))
+				return
 			}
-		}()
-		if exists {
-			r.Reply("I've already sent you the launch codes, contact an administrator if you're having problems")
+			r.Log(bot.Audit, fmt.Sprintf("User \"%s\" is replacing their TOTP launch codes", r.User))
+		}
+		enroll(r, user)
+		return
+	case "verify":
+		var userOTP launchCodes
+		_, exists, ret := r.CheckoutDatum(user, &userOTP, false)
+		if ret != bot.Ok {
+			r.Say("Yikes! - Something went wrong with my brain, have an admin check my log")
+			return
+		}
+		if !exists || !userOTP.enrolled() {
+			r.Reply("You don't have launch codes yet - ask me to \"send launch codes\" first")
 			return
 		}
-		otpb := make([]byte, 10)
-		random.Read(otpb)
-		userOTP.Secret = base32.StdEncoding.EncodeToString(otpb)
-		userOTP.WindowSize = 2
-		userOTP.DisallowReuse = []int{}
-		var codeMail bytes.Buffer
-		fmt.Fprintf(&codeMail, "For your authenticator:\n%s\n", userOTP.Secret)
-		// Sending email takes longer than the timeout, so we check it in and check
-		// out again after.
-		r.CheckinDatum(r.User, lock)
-		if ret = r.Email("Your launch codes - if you print this email, please chew it up and swallow it", &codeMail); ret != bot.Ok {
-			r.Reply("There was a problem sending your launch codes, contact an administrator")
+		if r.Channel != "" {
+			r.Say("I'll message you directly")
+		}
+		rep, ret := r.Direct().PromptForReply("OTP", "Please provide a launch code from your authenticator")
+		if ret != bot.Ok {
+			r.Log(bot.Debug, fmt.Sprintf("User \"%s\" didn't respond to launch code verification prompt", r.User))
 			return
 		}
-		lock, _, ret = r.CheckoutDatum(r.User, &userOTP, true)
-		updated = true
-		r.Reply("I've emailed your launch codes - please delete it promptly")
+		ok, pret := checkOTP(r, rep)
+		switch {
+		case pret != bot.Success:
+			r.Direct().Say("There were technical issues validating your code, ask an administrator to check the log")
+		case ok:
+			r.Log(bot.Audit, fmt.Sprintf("User \"%s\" verified their TOTP enrollment", r.User))
+			r.Direct().Say("That code is valid - you're all set for elevation")
+		default:
+			r.Direct().Say("Sorry, that code isn't valid; check that your device clock is correct, or try the next code")
+		}
+		return
+	case "reset":
+		// launch codes are kept under the canonical identity
+		target := r.GetCanonicalUser(args[0])
+		if !r.HasPermission(resetPermission) {
+			r.Log(bot.Audit, fmt.Sprintf("User \"%s\" denied resetting the TOTP launch codes for \"%s\"", r.User, target))
+			r.Reply(fmt.Sprintf("Sorry, resetting launch codes requires the \"%s\" permission", resetPermission))
+			return
+		}
+		var userOTP launchCodes
+		lock, exists, ret := r.CheckoutDatum(target, &userOTP, true)
+		if ret != bot.Ok {
+			r.Say("Yikes! - Something went wrong with my brain, have an admin check my log")
+			return
+		}
+		if !exists || !userOTP.enrolled() {
+			r.CheckinDatum(target, lock)
+			r.Reply(fmt.Sprintf("User \"%s\" doesn't have launch codes", target))
+			return
+		}
+		if ret = r.UpdateDatum(target, lock, &launchCodes{}); ret != bot.Ok {
+			r.Log(bot.Error, fmt.Sprintf("Couldn't reset OTP config for %s: %s", target, ret))
+			r.Reply("Sorry, I wasn't able to reset those launch codes - have somebody check my log")
+			return
+		}
+		r.RevokeElevationSession(target)
+		r.Log(bot.Audit, fmt.Sprintf("User \"%s\" reset the TOTP launch codes for \"%s\"", r.User, target))
+		r.Reply(fmt.Sprintf("Launch codes for \"%s\" have been reset; they can get new ones with \"send launch codes\"", target))
 		return
 	case "elevate":
 		immediate := false
@@ -141,40 +268,12 @@ func elevate(r *bot.Robot, command string, args ...string) (retval bot.PlugRetVa
 		}
 		cfg := &config{}
 		r.GetPluginConfig(&cfg)
-		if cfg.TimeoutType == "absolute" {
-			cfg.tt = absolute
-		}
-		cfg.tf64 = float64(cfg.TimeoutSeconds)
-		now := time.Now().UTC()
-		ask := false
-		if immediate {
-			retval = getcode(r, immediate)
-		} else {
-			timeoutLock.RLock()
-			le, ok := lastElevate[r.User]
-			timeoutLock.RUnlock()
-			if ok {
-				diff := now.Sub(le)
-				if diff.Seconds() > cfg.tf64 {
-					ask = true
-				} else {
-					retval = bot.Success
-				}
-			} else {
-				ask = true
-			}
-			if ask {
-				retval = getcode(r, immediate)
-			}
+		if !immediate && r.CheckElevationSession(cfg.TimeoutSeconds, cfg.TimeoutType) {
+			return bot.Success
 		}
-		if retval == bot.Success && cfg.tt == idle {
-			timeoutLock.Lock()
-			lastElevate[r.User] = now
-			timeoutLock.Unlock()
-		} else if retval == bot.Success && ask && cfg.tt == absolute {
-			timeoutLock.Lock()
-			lastElevate[r.User] = now
-			timeoutLock.Unlock()
+		retval = getcode(r, immediate)
+		if retval == bot.Success {
+			r.StartElevationSession(cfg.TimeoutSeconds)
 		}
 		return
 	}
@@ -188,10 +287,21 @@ Config:
   TimeoutType: idle # or absolute
 Help:
 - Keywords: [ "send", "launch", "codes" ]
-  Helptext: [ "(bot), send launch codes - one-time send of Google Authenticator string token, for use with TOTP elevation" ]
+  Helptext: [ "(bot), send launch codes - one-time email of a QR code for your authenticator app, for use with TOTP elevation" ]
+- Keywords: [ "verify", "launch", "code", "codes" ]
+  Helptext: [ "(bot), verify launch code - check that your authenticator is giving valid launch codes" ]
+- Keywords: [ "reset", "launch", "codes" ]
+  Helptext: [ "(bot), reset launch codes for <user> - (requires the totp.reset permission) let a user enroll again" ]
 CommandMatchers:
 - Command: "send"
   Regex: '(?i:send (?:launch )?codes?)'
+- Command: "verify"
+  Regex: '(?i:verify (?:launch )?codes?)'
+- Command: "reset"
+  Regex: '(?i:reset (?:launch )?codes? for ([\w.@:-]+))'
+ReplyMatchers:
+- Label: launchcode
+  Regex: '(?:\d{6}|[a-zA-Z2-7]{4}-?[a-zA-Z2-7]{4})'
 `
 
 func init() {
@@ -0,0 +1,455 @@
+package totp
+
+/* qrcode.go - a small QR code encoder, just enough for otpauth:// URIs:
+   byte mode, error correction level M, versions 1-10 (up to 213 bytes),
+   rendered as a PNG. */
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Size of QR code
+const qrsize = 400
+
+// quiet zone around the code, in modules
+const qrBorder = 4
+
+// qrVersion describes the level M error correction blocks and alignment
+// pattern positions for a version
+type qrVersion struct {
+	ecPerBlock int   // error correction codewords per block
+	blocks     []int // data codewords in each block
+	align      []int // alignment pattern center coordinates
+}
+
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// dataCodewords is the total data capacity of a version
+func (v qrVersion) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+// bitBuffer accumulates the encoded data
+type bitBuffer []bool
+
+func (b *bitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, val>>uint(i)&1 == 1)
+	}
+}
+
+// GF(256) arithmetic for Reed-Solomon, with the QR polynomial 0x11d
+var gfExp, gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]+gfLog[b])%255]
+}
+
+// rsRemainder computes n error correction codewords for a block
+func rsRemainder(data []byte, n int) []byte {
+	// generator polynomial (x - a^0)(x - a^1)...(x - a^(n-1)), highest
+	// coefficient (always 1) omitted
+	gen := make([]int, n)
+	gen[n-1] = 1
+	root := 1
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	rem := make([]int, n)
+	for _, d := range data {
+		factor := int(d) ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	ec := make([]byte, n)
+	for i, r := range rem {
+		ec[i] = byte(r)
+	}
+	return ec
+}
+
+// qrCode is the module grid; true is dark
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // modules that are part of function patterns
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	return q
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment patterns and
+// version information, and reserves the format information areas.
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				d := chebyshev(dx, dy)
+				q.setFunction(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	align := qrVersions[version-1].align
+	last := len(align) - 1
+	for i, cx := range align {
+		for j, cy := range align {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // overlaps a finder pattern
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, chebyshev(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(0) // reserve the area; redrawn after masking
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for level M
+// and the given mask, plus the dark module.
+func (q *qrCode) drawFormatBits(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords places the data in the zigzag pattern, bottom right first
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upward
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func maskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask xors the mask onto the data modules; applying it twice undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.function[y][x] && maskBit(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the rules from ISO 18004; the mask with
+// the lowest score is used.
+func (q *qrCode) penalty() int {
+	score := 0
+	finderLike := func(line []bool, i int) bool {
+		pattern := []bool{true, false, true, true, true, false, true}
+		for k, p := range pattern {
+			if line[i+k] != p {
+				return false
+			}
+		}
+		light := func(from, to int) bool {
+			for k := from; k < to; k++ {
+				if k >= 0 && k < len(line) && line[k] {
+					return false
+				}
+			}
+			return true
+		}
+		return light(i-4, i) || light(i+7, i+11)
+	}
+	lineScore := func(line []bool) {
+		run := 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				score += run - 2
+			}
+			run = 1
+		}
+		for i := 0; i+7 <= len(line); i++ {
+			if finderLike(line, i) {
+				score += 40
+			}
+		}
+	}
+	dark := 0
+	col := make([]bool, q.size)
+	for y := 0; y < q.size; y++ {
+		lineScore(q.modules[y])
+		for x := 0; x < q.size; x++ {
+			col[x] = q.modules[x][y]
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if q.modules[y-1][x] == c && q.modules[y][x-1] == c && q.modules[y-1][x-1] == c {
+					score += 3
+				}
+			}
+		}
+		lineScore(col)
+	}
+	total := q.size * q.size
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+// encodeQR builds the QR code for text
+func encodeQR(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for i, v := range qrVersions {
+		countBits := 8
+		if i+1 >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= v.dataCodewords()*8 {
+			version = i + 1
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("text too long for a QR code")
+	}
+	v := qrVersions[version-1]
+	capacity := v.dataCodewords() * 8
+	var bb bitBuffer
+	bb.append(0x4, 4) // byte mode
+	if version >= 10 {
+		bb.append(len(data), 16)
+	} else {
+		bb.append(len(data), 8)
+	}
+	for _, c := range data {
+		bb.append(int(c), 8)
+	}
+	terminator := capacity - len(bb)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bb.append(0, terminator)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := 0xec; len(bb) < capacity; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	codewords := make([]byte, len(bb)/8)
+	for i, b := range bb {
+		if b {
+			codewords[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+	// split into blocks, add error correction, and interleave
+	var blocks, ecs [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, codewords[:n])
+		ecs = append(ecs, rsRemainder(codewords[:n], v.ecPerBlock))
+		codewords = codewords[n:]
+	}
+	var final []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				final = append(final, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, ec := range ecs {
+			final = append(final, ec[i])
+		}
+	}
+	q := newQRCode(version)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(final)
+	best, bestScore := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if s := q.penalty(); bestScore < 0 || s < bestScore {
+			best, bestScore = mask, s
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrPNG renders text as a qrsize x qrsize PNG QR code
+func qrPNG(text string) ([]byte, error) {
+	q, err := encodeQR(text)
+	if err != nil {
+		return nil, err
+	}
+	scale := qrsize / (q.size + 2*qrBorder)
+	offset := (qrsize - q.size*scale) / 2
+	img := image.NewGray(image.Rect(0, 0, qrsize, qrsize))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetGray(offset+x*scale+px, offset+y*scale+py, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// chebyshev is the distance from a pattern's center, for drawing it's rings
+func chebyshev(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
@@ -0,0 +1,337 @@
+package totp
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// Level M format information for masks 0-7, from ISO 18004 Table C.1
+var formatM = []string{
+	"101010000010010",
+	"101000100100101",
+	"101111001111100",
+	"101101101001011",
+	"100010111111001",
+	"100000011001110",
+	"100111110010111",
+	"100101010100000",
+}
+
+// Version information for versions 7-10, from ISO 18004 Table D.1
+var versionInfo = map[int]int{7: 0x07c94, 8: 0x085bc, 9: 0x09a99, 10: 0x0a4d3}
+
+// masked gives the data masks from ISO 18004 Table 10, for row i and
+// column j
+func masked(mask, i, j int) bool {
+	switch mask {
+	case 0:
+		return (i+j)%2 == 0
+	case 1:
+		return i%2 == 0
+	case 2:
+		return j%3 == 0
+	case 3:
+		return (i+j)%3 == 0
+	case 4:
+		return (i/2+j/3)%2 == 0
+	case 5:
+		return (i*j)%2+(i*j)%3 == 0
+	case 6:
+		return ((i*j)%2+(i*j)%3)%2 == 0
+	}
+	return ((i+j)%2+(i*j)%3)%2 == 0
+}
+
+// TestReedSolomon checks the error correction for the "HELLO WORLD" 1-M
+// example from the QR code tutorial at thonky.com.
+func TestReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+// sampleQR reads the module grid back from a PNG made by qrPNG, measuring
+// the scale from the top left finder pattern.
+func sampleQR(t *testing.T, pngData []byte) [][]bool {
+	img, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		t.Fatalf("Decoding PNG: %v", err)
+	}
+	b := img.Bounds()
+	if b.Dx() != qrsize || b.Dy() != qrsize {
+		t.Fatalf("Image is %dx%d, want %dx%d", b.Dx(), b.Dy(), qrsize, qrsize)
+	}
+	dark := func(x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r < 0x8000
+	}
+	offset := -1
+	for i := 0; i < qrsize && offset < 0; i++ {
+		if dark(i, i) {
+			offset = i
+		}
+	}
+	if offset < 0 {
+		t.Fatal("No dark pixels in the image")
+	}
+	run := 0
+	for x := offset; x < qrsize && dark(x, offset); x++ {
+		run++
+	}
+	if run%7 != 0 {
+		t.Fatalf("Finder pattern is %d pixels wide, not a multiple of 7", run)
+	}
+	scale := run / 7
+	size := (qrsize - 2*offset) / scale
+	if (size-17)%4 != 0 || size < 21 || size > 57 {
+		t.Fatalf("Symbol is %d modules wide, not a version 1-10 size", size)
+	}
+	grid := make([][]bool, size)
+	for y := range grid {
+		grid[y] = make([]bool, size)
+		for x := range grid[y] {
+			grid[y][x] = dark(offset+x*scale+scale/2, offset+y*scale+scale/2)
+		}
+	}
+	return grid
+}
+
+// decodeQR decodes the byte mode text from a level M symbol, returning it
+// and the mask used
+func decodeQR(t *testing.T, grid [][]bool) (string, int) {
+	size := len(grid)
+	version := (size - 17) / 4
+	// read the first copy of the format information
+	var format []byte
+	bit := func(x, y int) {
+		if grid[y][x] {
+			format = append(format, '1')
+		} else {
+			format = append(format, '0')
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		bit(8, i)
+	}
+	bit(8, 7)
+	bit(8, 8)
+	bit(7, 8)
+	for i := 9; i < 15; i++ {
+		bit(14-i, 8)
+	}
+	// bits were read least significant first
+	for i, j := 0, len(format)-1; i < j; i, j = i+1, j-1 {
+		format[i], format[j] = format[j], format[i]
+	}
+	mask := -1
+	for m, f := range formatM {
+		if string(format) == f {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("Format information %s isn't level M", format)
+	}
+	if version >= 7 {
+		info := 0
+		for i := 17; i >= 0; i-- {
+			info <<= 1
+			if grid[i/3][size-11+i%3] {
+				info |= 1
+			}
+		}
+		if info != versionInfo[version] {
+			t.Fatalf("Version information is %05x, want %05x", info, versionInfo[version])
+		}
+	}
+	// the function pattern layout, to skip while reading data
+	ref := newQRCode(version)
+	ref.drawFunctionPatterns(version)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if ref.function[y][x] && !isFormatArea(size, x, y) && ref.modules[y][x] != grid[y][x] {
+				t.Fatalf("Function pattern module (%d, %d) is wrong", x, y)
+			}
+		}
+	}
+	var codewords []byte
+	var cur byte
+	n := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+			for x := right; x > right-2; x-- {
+				if ref.function[y][x] {
+					continue
+				}
+				dark := grid[y][x]
+				if masked(mask, y, x) {
+					dark = !dark
+				}
+				cur <<= 1
+				if dark {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					codewords = append(codewords, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+	// de-interleave the blocks, and check the error correction by
+	// evaluating each block's polynomial at the generator's roots
+	v := qrVersions[version-1]
+	blocks := make([][]byte, len(v.blocks))
+	i := 0
+	for k := 0; k < v.blocks[len(v.blocks)-1]; k++ {
+		for b, l := range v.blocks {
+			if k < l {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, b...)
+	}
+	for k := 0; k < v.ecPerBlock; k++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[i])
+			i++
+		}
+	}
+	for b, block := range blocks {
+		for root := 0; root < v.ecPerBlock; root++ {
+			s := 0
+			for _, c := range block {
+				s = gfMul(s, gfExp[root]) ^ int(c)
+			}
+			if s != 0 {
+				t.Fatalf("Block %d has a non-zero syndrome for root %d", b, root)
+			}
+		}
+	}
+	// byte mode segment
+	var bits []bool
+	for _, c := range data {
+		for k := 7; k >= 0; k-- {
+			bits = append(bits, c>>uint(k)&1 == 1)
+		}
+	}
+	read := func(n int) int {
+		v := 0
+		for k := 0; k < n; k++ {
+			v <<= 1
+			if bits[0] {
+				v |= 1
+			}
+			bits = bits[1:]
+		}
+		return v
+	}
+	if mode := read(4); mode != 0x4 {
+		t.Fatalf("Mode is %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	length := read(countBits)
+	text := make([]byte, length)
+	for k := range text {
+		text[k] = byte(read(8))
+	}
+	// then the terminator and zeros to a byte boundary, and alternating
+	// pad codewords
+	for len(bits)%8 != 0 {
+		if read(1) != 0 {
+			t.Fatal("Non-zero bits after the data")
+		}
+	}
+	for pad := 0xec; len(bits) > 0; pad ^= 0xec ^ 0x11 {
+		if c := read(8); c != pad {
+			t.Fatalf("Pad codeword is %#x, want %#x", c, pad)
+		}
+	}
+	return string(text), mask
+}
+
+// isFormatArea is true for the modules holding format information, which
+// drawFunctionPatterns only reserves
+func isFormatArea(size, x, y int) bool {
+	return (x == 8 && (y <= 8 || y >= size-8)) || (y == 8 && (x <= 8 || x >= size-8))
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	uri := "otpauth://totp/Floyd:alice?issuer=Floyd&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+	for _, text := range []string{
+		"a",
+		"HELLO WORLD",
+		uri,
+		strings.Repeat("x", 150), // version 7 and up have version information
+		strings.Repeat("z", 213), // the largest version 10 symbol
+	} {
+		img, err := qrPNG(text)
+		if err != nil {
+			t.Errorf("qrPNG for %d bytes: %v", len(text), err)
+			continue
+		}
+		if got, _ := decodeQR(t, sampleQR(t, img)); got != text {
+			t.Errorf("Decoded %q, want %q", got, text)
+		}
+	}
+}
+
+// TestQRMasks decodes symbols until it's seen every mask
+func TestQRMasks(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 1000 && len(seen) < 8; i++ {
+		text := fmt.Sprintf("otpauth://totp/Floyd:user%d?secret=%d", i, i*7919)
+		img, err := qrPNG(text)
+		if err != nil {
+			t.Fatalf("qrPNG: %v", err)
+		}
+		got, mask := decodeQR(t, sampleQR(t, img))
+		if got != text {
+			t.Fatalf("Decoded %q with mask %d, want %q", got, mask, text)
+		}
+		seen[mask] = true
+	}
+	if len(seen) < 8 {
+		t.Errorf("Only saw masks %v", seen)
+	}
+}
+
+func TestQRVersions(t *testing.T) {
+	for _, tc := range []struct {
+		length, version int
+	}{
+		{14, 1}, {15, 2}, {26, 2}, {27, 3}, {180, 9}, {181, 10}, {213, 10},
+	} {
+		q, err := encodeQR(strings.Repeat("a", tc.length))
+		if err != nil {
+			t.Errorf("encodeQR for %d bytes: %v", tc.length, err)
+			continue
+		}
+		if version := (q.size - 17) / 4; version != tc.version {
+			t.Errorf("%d bytes used version %d, want %d", tc.length, version, tc.version)
+		}
+	}
+	if _, err := encodeQR(strings.Repeat("a", 214)); err == nil {
+		t.Error("encodeQR accepted 214 bytes")
+	}
+}
@@ -0,0 +1,88 @@
+package totp
+
+/* recovery.go - the launch codes stored for each user, and single-use
+   recovery codes that can be given in place of a TOTP code when the user
+   doesn't have their authenticator. Only hashes of the recovery codes are
+   stored. */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+
+	otp "github.com/dgryski/dgoogauth"
+)
+
+// how many recovery codes users get when they enroll
+const recoveryCodeCount = 10
+
+// launchCodes is stored in the brain under the user's canonical identity.
+// The OTP configuration is embedded so launch codes saved before recovery
+// codes existed still load.
+type launchCodes struct {
+	otp.OTPConfig
+	RecoveryCodes []string // SHA-256 hashes of unused recovery codes
+}
+
+// enrolled is false for users that never enrolled, or were reset by an
+// administrator
+func (l *launchCodes) enrolled() bool {
+	return l.Secret != ""
+}
+
+// newSecret generates a random base32 TOTP secret
+func newSecret() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes in any case, with
+// or without the dash
+func normalizeRecoveryCode(code string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(code)), "-", "", -1)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes generates a set of recovery codes like "abcd-efgh",
+// returning the codes for the user and the hashes to store.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	b := make([]byte, 5)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := c[:4] + "-" + c[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// isRecoveryCode distinguishes recovery codes from 6-digit TOTP codes
+func isRecoveryCode(code string) bool {
+	return len(normalizeRecoveryCode(code)) == 8
+}
+
+// useRecoveryCode checks a recovery code, removing it if it's valid so it
+// can't be used again.
+func (l *launchCodes) useRecoveryCode(code string) bool {
+	h := []byte(hashRecoveryCode(code))
+	for i, stored := range l.RecoveryCodes {
+		if subtle.ConstantTimeCompare(h, []byte(stored)) == 1 {
+			l.RecoveryCodes = append(l.RecoveryCodes[:i], l.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
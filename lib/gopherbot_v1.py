@@ -108,6 +108,9 @@ class Robot:
     def CheckAdmin(self):
         return self.Call("CheckAdmin", {})["Boolean"]
 
+    def HasPermission(self, perm):
+        return self.Call("HasPermission", { "Permission": perm })["Boolean"]
+
     def Elevate(self, immediate=False):
         return self.Call("Elevate", { "Immediate": immediate })["Boolean"]
 
@@ -101,6 +101,10 @@ class BaseBot
 		return callBotFunc("CheckAdmin", {})["Boolean"]
 	end
 
+	def HasPermission(perm)
+		return callBotFunc("HasPermission", { "Permission" => perm })["Boolean"]
+	end
+
 	def Elevate(immediate=false)
 		return callBotFunc("Elevate", { "Immediate" => immediate })["Boolean"]
 	end
@@ -103,6 +103,20 @@ CheckAdmin(){
 	fi
 }
 
+HasPermission(){
+	local GB_FUNCARGS="{ \"Permission\": \"$1\" }"
+	local GB_FUNCNAME="HasPermission"
+	GB_RET=$(gbPostJSON $GB_FUNCNAME "$GB_FUNCARGS")
+	local RETVAL=$(echo "$GB_RET" | jq .Boolean)
+	echo "$RETVAL"
+	if [ "$RETVAL" = "true" ]
+	then
+		return 0
+	else
+		return 1
+	fi
+}
+
 CallPlugin(){
 	local GB_FUNCNAME="CallPlugin"
 	local PLUGNAME=$1
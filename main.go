@@ -15,8 +15,12 @@ import (
 	// otherwise you can disable them in conf/plugins/<plugin>.json with
 	// "Disabled: true"
 	_ "github.com/uva-its/gopherbot/goplugins/duo"
+	_ "github.com/uva-its/gopherbot/goplugins/emailotp"
 	_ "github.com/uva-its/gopherbot/goplugins/totp"
 
+	// If re-compiling, you can comment out unused authorizer implementations.
+	_ "github.com/uva-its/gopherbot/goplugins/ldapcheck"
+
 	// If re-compiling, you can select the plugins you want. Otherwise you can disable
 	// them in conf/plugins/<plugin>.json with "Disabled: true"
 	_ "github.com/uva-its/gopherbot/goplugins/help"